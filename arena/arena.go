@@ -0,0 +1,77 @@
+// Created on 2021/4/22 by @zzl
+package arena
+
+import (
+	"sync/atomic"
+)
+
+// Size of the chunks memory is carved from.  Allocations larger than a
+// quarter of it get a chunk of their own so that little space is wasted
+// at the end of a chunk.
+const ChunkSize = 64 << 10
+
+// Arena hands out memory from large chunks, so that many small objects
+// cost a few allocations instead of one each.  Allocated memory is
+// addressed by offsets, which encode the chunk index in the upper 32 bits
+// and the position inside the chunk in the lower 32 bits.
+//
+// Allocate must not be called concurrently, but Get and MemoryUsage may be
+// called concurrently with Allocate.
+type Arena struct {
+	// [][]byte, republished whenever a chunk is added
+	chunks atomic.Value
+	// Remaining space of the current chunk
+	current      []byte
+	currentIndex int
+	memoryUsage  int64
+}
+
+func New() *Arena {
+	var a Arena
+	a.chunks.Store([][]byte(nil))
+	return &a
+}
+
+// Allocates n bytes, returns their offset and the memory itself.
+func (a *Arena) Allocate(n int) (uint64, []byte) {
+	if n > len(a.current) {
+		if n > ChunkSize/4 {
+			// the rest of the current chunk stays usable
+			index := a.newChunk(n)
+			return uint64(index) << 32, a.chunk(index)[:n:n]
+		}
+		a.currentIndex = a.newChunk(ChunkSize)
+		a.current = a.chunk(a.currentIndex)
+	}
+	pos := ChunkSize - len(a.current)
+	p := a.current[:n:n]
+	a.current = a.current[n:]
+	return uint64(a.currentIndex)<<32 | uint64(pos), p
+}
+
+// Returns the n bytes allocated at offset.
+func (a *Arena) Get(offset uint64, n int) []byte {
+	chunk := a.chunk(int(offset >> 32))
+	pos := int(uint32(offset))
+	return chunk[pos : pos+n : pos+n]
+}
+
+// Returns the number of bytes allocated for chunks.
+func (a *Arena) MemoryUsage() int64 {
+	return atomic.LoadInt64(&a.memoryUsage)
+}
+
+func (a *Arena) chunk(index int) []byte {
+	return a.chunks.Load().([][]byte)[index]
+}
+
+func (a *Arena) newChunk(size int) int {
+	chunks := a.chunks.Load().([][]byte)
+	// never append in place, readers may hold the old slice
+	newChunks := make([][]byte, len(chunks)+1)
+	copy(newChunks, chunks)
+	newChunks[len(chunks)] = make([]byte, size)
+	a.chunks.Store(newChunks)
+	atomic.AddInt64(&a.memoryUsage, int64(size))
+	return len(chunks)
+}
@@ -1,10 +1,105 @@
 // Created on 2021/3/22 by @zzl
 package common
 
-type Comparator func(a, b interface{}) int
+import "bytes"
 
-func IntComparator(a, b interface{}) int {
-	aInt := a.(int)
-	bInt := b.(int)
-	return aInt - bInt
+// A Comparator provides a total order across user keys.  The order of a
+// database must never change, so its name is persisted and checked every
+// time the database is opened.
+type Comparator interface {
+	// Returns a value < 0 if a < b, 0 if a == b and > 0 if a > b.
+	Compare(a, b []byte) int
+	// The name of the comparator, a comparator which orders keys
+	// differently must have a different name.
+	Name() string
+	// If start < limit, returns a short key in [start,limit).
+	// Used to shorten the keys stored in the index block.
+	FindShortestSeparator(start, limit []byte) []byte
+	// Returns a short key >= key.
+	// Used to shorten the key of the last entry in the index block.
+	FindShortSuccessor(key []byte) []byte
+}
+
+// Name of BytewiseComparator, persisted so that tables written with a
+// different ordering can be detected.
+const UserKeyComparatorName = "asukadb.BytewiseComparator"
+
+// Orders keys lexicographically by their bytes, the default comparator.
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (bytewiseComparator) Name() string {
+	return UserKeyComparatorName
+}
+
+func (bytewiseComparator) FindShortestSeparator(start, limit []byte) []byte {
+	// Find length of common prefix
+	minLength := len(start)
+	if len(limit) < minLength {
+		minLength = len(limit)
+	}
+	diffIndex := 0
+	for diffIndex < minLength && start[diffIndex] == limit[diffIndex] {
+		diffIndex++
+	}
+
+	if diffIndex < minLength {
+		diffByte := start[diffIndex]
+		if diffByte < 0xff && diffByte+1 < limit[diffIndex] {
+			separator := make([]byte, diffIndex+1)
+			copy(separator, start)
+			separator[diffIndex]++
+			return separator
+		}
+	}
+	// Do not shorten if one string is a prefix of the other
+	return start
+}
+
+func (bytewiseComparator) FindShortSuccessor(key []byte) []byte {
+	// Find first character that can be incremented
+	for i := 0; i < len(key); i++ {
+		if key[i] != 0xff {
+			successor := make([]byte, i+1)
+			copy(successor, key)
+			successor[i]++
+			return successor
+		}
+	}
+	// key is a run of 0xffs.  Leave it alone.
+	return key
+}
+
+// Orders internal keys by increasing user key, according to the user
+// comparator, then by decreasing sequence number.
+type InternalKeyComparator struct {
+	UserComparator Comparator
+}
+
+func NewInternalKeyComparator(cmp Comparator) InternalKeyComparator {
+	if cmp == nil {
+		cmp = BytewiseComparator
+	}
+	return InternalKeyComparator{UserComparator: cmp}
+}
+
+func (icmp InternalKeyComparator) Compare(a, b *InternalKey) int {
+	// Order by:
+	//    increasing user key (according to user-supplied comparator)
+	//    decreasing sequence number
+	//    decreasing type (though sequence# should be enough to disambiguate)
+	r := icmp.UserComparator.Compare(a.UserKey, b.UserKey)
+	if r == 0 {
+		if a.Seq > b.Seq {
+			r = -1
+		} else if a.Seq < b.Seq {
+			r = +1
+		}
+	}
+	return r
 }
@@ -4,8 +4,18 @@ package common
 import "errors"
 
 var (
-	ErrNotFound          = errors.New("not found")
-	ErrDeletion          = errors.New("deletion")
-	ErrTableFileMagic    = errors.New("not an sstable (bad magic number)")
-	ErrTableFileTooShort = errors.New("file is too short to be an sstable")
+	ErrNotFound                 = errors.New("not found")
+	ErrDeletion                 = errors.New("deletion")
+	ErrTableFileMagic           = errors.New("not an sstable (bad magic number)")
+	ErrTableFileTooShort        = errors.New("file is too short to be an sstable")
+	ErrTableFileCorrupted       = errors.New("corrupted sstable")
+	ErrUnsupportedFormatVersion = errors.New("unsupported sstable format version")
+	ErrCreateFile               = errors.New("failed to create file")
+	ErrKeysNotSorted            = errors.New("keys must be added in strictly increasing order")
+	ErrEmptyFile                = errors.New("cannot create an empty sstable")
+	ErrNotExternalFile          = errors.New("sstable was not written by SstFileWriter")
+	ErrOverlappingFiles         = errors.New("ingested files overlap each other")
+	ErrComparatorMismatch       = errors.New("comparator does not match the one the database was created with")
+	ErrManifestCorrupted        = errors.New("corrupted manifest")
+	ErrInvalidOptions           = errors.New("invalid options")
 )
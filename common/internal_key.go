@@ -2,7 +2,6 @@
 package common
 
 import (
-	"bytes"
 	"encoding/binary"
 	"io"
 	"math"
@@ -44,44 +43,69 @@ func (key *InternalKey) EncodeTo(w io.Writer) error {
 	return binary.Write(w, binary.LittleEndian, key.UserValue)
 }
 
+// Fails with ErrManifestCorrupted if r does not hold a key encoded by
+// EncodeTo.
 func (key *InternalKey) DecodeFrom(r io.Reader) error {
 	var tmp int32
-	binary.Read(r, binary.LittleEndian, &key.Seq)
-	binary.Read(r, binary.LittleEndian, &key.Type)
-	binary.Read(r, binary.LittleEndian, &tmp)
+	if binary.Read(r, binary.LittleEndian, &key.Seq) != nil ||
+		binary.Read(r, binary.LittleEndian, &key.Type) != nil ||
+		binary.Read(r, binary.LittleEndian, &tmp) != nil || tmp < 0 {
+		return ErrManifestCorrupted
+	}
 	key.UserKey = make([]byte, tmp)
-	binary.Read(r, binary.LittleEndian, key.UserKey)
-	binary.Read(r, binary.LittleEndian, &tmp)
+	if binary.Read(r, binary.LittleEndian, key.UserKey) != nil ||
+		binary.Read(r, binary.LittleEndian, &tmp) != nil || tmp < 0 {
+		return ErrManifestCorrupted
+	}
 	key.UserValue = make([]byte, tmp)
-	return binary.Read(r, binary.LittleEndian, key.UserValue)
+	if binary.Read(r, binary.LittleEndian, key.UserValue) != nil {
+		return ErrManifestCorrupted
+	}
+	return nil
 }
 
 func LookupKey(key []byte) *InternalKey {
 	return NewInternalKey(math.MaxUint64, TypeValue, key, nil)
 }
 
-func InternalKeyComparator(a, b interface{}) int {
-	// Order by:
-	//    increasing user key (according to user-supplied comparator)
-	//    decreasing sequence number
-	//    decreasing type (though sequence# should be enough to disambiguate)
-	aKey := a.(*InternalKey)
-	bKey := b.(*InternalKey)
-	r := UserKeyComparator(aKey.UserKey, bKey.UserKey)
-	if r == 0 {
-		aNum := aKey.Seq
-		bNum := bKey.Seq
-		if aNum > bNum {
-			r = -1
-		} else if aNum < bNum {
-			r = +1
-		}
-	}
-	return r
+// Returns the number of bytes taken by the encoding of the key.
+func (key *InternalKey) EncodedLength() int {
+	return 13 + len(key.UserKey) + 4 + len(key.UserValue)
 }
 
-func UserKeyComparator(a, b interface{}) int {
-	aKey := a.([]byte)
-	bKey := b.([]byte)
-	return bytes.Compare(aKey, bKey)
+// Encodes the key like EncodeTo into p, which must hold at least
+// EncodedLength bytes.  Returns the number of bytes written.
+func (key *InternalKey) EncodeToBytes(p []byte) int {
+	binary.LittleEndian.PutUint64(p, key.Seq)
+	p[8] = byte(key.Type)
+	binary.LittleEndian.PutUint32(p[9:], uint32(len(key.UserKey)))
+	n := 13 + copy(p[13:], key.UserKey)
+	binary.LittleEndian.PutUint32(p[n:], uint32(len(key.UserValue)))
+	n += 4
+	return n + copy(p[n:], key.UserValue)
+}
+
+// Decodes an internal key encoded by EncodeTo without copying, the user key
+// and value reference p directly.  Returns the number of bytes consumed,
+// or 0 if p does not hold a complete internal key.
+func (key *InternalKey) DecodeFromBytes(p []byte) int {
+	if len(p) < 13 {
+		return 0
+	}
+	key.Seq = binary.LittleEndian.Uint64(p)
+	key.Type = ValueType(p[8])
+	keyLen := int(int32(binary.LittleEndian.Uint32(p[9:])))
+	n := 13
+	if keyLen < 0 || len(p)-n < keyLen+4 {
+		return 0
+	}
+	key.UserKey = p[n : n+keyLen : n+keyLen]
+	n += keyLen
+	valueLen := int(int32(binary.LittleEndian.Uint32(p[n:])))
+	n += 4
+	if valueLen < 0 || len(p)-n < valueLen {
+		return 0
+	}
+	key.UserValue = p[n : n+valueLen : n+valueLen]
+	return n + valueLen
 }
@@ -0,0 +1,66 @@
+// Created on 2021/4/30 by @zzl
+package db
+
+import (
+	"asukadb/common"
+	"fmt"
+	"testing"
+)
+
+func TestCompactRange(t *testing.T) {
+	removeDBFiles("COMPACT")
+	defer removeDBFiles("COMPACT")
+
+	db := openDB(t, "COMPACT", nil)
+	defer db.Close()
+	// three overlapping tables in level 0
+	for round := 0; round < 3; round++ {
+		for i := round; i < 3000; i += 3 {
+			db.Put([]byte(fmt.Sprintf("key%06d", i)), []byte(fmt.Sprint(round)))
+		}
+		db.mu.Lock()
+		db.flushMemTable()
+		db.mu.Unlock()
+	}
+	db.Put([]byte("key999999"), []byte("in memory"))
+
+	stats, err := db.CompactRange(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Compactions == 0 || stats.BytesRead == 0 || stats.BytesWritten == 0 {
+		t.Fatalf("got %+v", stats)
+	}
+	db.mu.Lock()
+	empty := db.memTable.Empty()
+	numLevel0Files := db.currentVersion.NumLevelFiles(0)
+	db.mu.Unlock()
+	if !empty || numLevel0Files != 0 {
+		t.Fatal("everything should be compacted out of level 0")
+	}
+	for i := 0; i < 3000; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key%06d", i)))
+		if err != nil || string(value) != fmt.Sprint(i%3) {
+			t.Fatal(i, err, string(value))
+		}
+	}
+
+	// a range holding nothing rewrites nothing
+	stats, err = db.CompactRange([]byte("other"), []byte("other2"))
+	if err != nil || stats.BytesWritten != 0 {
+		t.Fatal(err, stats)
+	}
+	// compacting the deletions doesn't bring the old values back
+	for i := 1000; i < 2000; i++ {
+		db.Del([]byte(fmt.Sprintf("key%06d", i)))
+	}
+	if _, err = db.CompactRange([]byte("key001000"), []byte("key001999")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Get([]byte("key001500")); err != common.ErrNotFound && err != common.ErrDeletion {
+		t.Fatal(err)
+	}
+	if value, err := db.Get([]byte("key002500")); err != nil || string(value) != "1" {
+		t.Fatal(err, string(value))
+	}
+}
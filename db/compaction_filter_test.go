@@ -0,0 +1,89 @@
+// Created on 2021/5/4 by @zzl
+package db
+
+import (
+	"asukadb/common"
+	"asukadb/options"
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// Removes the expired entries and upgrades the values of the legacy format
+type expiryFilter struct {
+	calls  int
+	manual bool
+}
+
+func (f *expiryFilter) Filter(level int, manual bool, key, value []byte) (options.CompactionFilterDecision, []byte) {
+	f.calls++
+	f.manual = f.manual || manual
+	if bytes.Equal(value, []byte("expired")) {
+		return options.CompactionFilterRemove, nil
+	}
+	if bytes.HasPrefix(value, []byte("v1:")) {
+		return options.CompactionFilterChangeValue, append([]byte("v2:"), value[3:]...)
+	}
+	return options.CompactionFilterKeep, nil
+}
+
+func (f *expiryFilter) Name() string {
+	return "expiryFilter"
+}
+
+func TestCompactionFilter(t *testing.T) {
+	removeDBFiles("COMPACTION_FILTER")
+	defer removeDBFiles("COMPACTION_FILTER")
+
+	filter := &expiryFilter{}
+	opts := options.New()
+	opts.CompactionFilter = filter
+	db := openDB(t, "COMPACTION_FILTER", opts)
+	defer db.Close()
+	// the snapshot sees "old", it must not be filtered
+	db.Put([]byte("old"), []byte("expired"))
+	snapshot := db.GetSnapshot()
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		switch i % 3 {
+		case 0:
+			db.Put(key, []byte("expired"))
+		case 1:
+			db.Put(key, []byte(fmt.Sprintf("v1:%d", i)))
+		default:
+			db.Put(key, []byte(fmt.Sprintf("v2:%d", i)))
+		}
+	}
+
+	if _, err := db.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if filter.calls == 0 || !filter.manual {
+		t.Fatalf("filter called %d times, manual %v", filter.calls, filter.manual)
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		value, err := db.Get(key)
+		if i%3 == 0 {
+			if err != common.ErrDeletion && err != common.ErrNotFound {
+				t.Fatalf("%s should be removed: %v %s", key, err, value)
+			}
+		} else if err != nil || string(value) != fmt.Sprintf("v2:%d", i) {
+			t.Fatalf("%s: %v %s", key, err, value)
+		}
+	}
+	ro := options.NewReadOptions()
+	ro.Snapshot = snapshot
+	if value, err := db.GetWithOptions([]byte("old"), ro); err != nil || string(value) != "expired" {
+		t.Fatalf("old in snapshot: %v %s", err, value)
+	}
+
+	// the entry is filtered once the snapshot is released
+	db.ReleaseSnapshot(snapshot)
+	if _, err := db.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get([]byte("old")); err != common.ErrDeletion && err != common.ErrNotFound {
+		t.Fatalf("old should be removed: %v %s", err, value)
+	}
+}
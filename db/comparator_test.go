@@ -0,0 +1,85 @@
+// Created on 2021/4/28 by @zzl
+package db
+
+import (
+	"asukadb/common"
+	"asukadb/options"
+	"asukadb/sstable"
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+func (reverseComparator) Name() string {
+	return "asukadb.ReverseBytewiseComparator"
+}
+
+func (reverseComparator) FindShortestSeparator(start, limit []byte) []byte {
+	return start
+}
+
+func (reverseComparator) FindShortSuccessor(key []byte) []byte {
+	return key
+}
+
+func TestComparator(t *testing.T) {
+	removeDBFiles("CMP")
+	defer removeDBFiles("CMP")
+
+	opts := options.New()
+	opts.Comparator = reverseComparator{}
+	db := openDB(t, "CMP", opts)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		db.Put(key, key)
+	}
+	db.mu.Lock()
+	db.flushMemTable()
+	db.mu.Unlock()
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		if value, err := db.Get(key); err != nil || !bytes.Equal(value, key) {
+			t.Fatalf("%s: %v %s", key, err, value)
+		}
+	}
+	props, err := db.GetPropertiesOfAllTables()
+	if err != nil || len(props) != 1 {
+		t.Fatal(props, err)
+	}
+	for fileName, p := range props {
+		if p.ComparatorName != opts.Comparator.Name() {
+			t.Fatalf("got comparator %s", p.ComparatorName)
+		}
+		if _, err = sstable.Open(fileName, options.New(), nil); err != common.ErrComparatorMismatch {
+			t.Fatalf("got %v", err)
+		}
+		table, err := sstable.Open(fileName, opts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		it := table.NewIterator(nil)
+		it.SeekToFirst()
+		if !it.Valid() || string(it.InternalKey().UserKey) != "key000999" {
+			t.Fatal("keys should be in reverse order")
+		}
+		it.Close()
+		table.Close()
+	}
+	db.Close()
+
+	if _, err = Open("CMP", nil); err != common.ErrComparatorMismatch {
+		t.Fatal("opening with another comparator should fail", err)
+	}
+	db = openDB(t, "CMP", opts)
+	defer db.Close()
+	if value, err := db.Get([]byte("key000500")); err != nil || string(value) != "key000500" {
+		t.Fatal(err)
+	}
+}
@@ -3,8 +3,14 @@ package db
 
 import (
 	"asukadb/common"
+	"asukadb/lru"
 	"asukadb/memtable"
+	"asukadb/options"
+	"asukadb/sstable"
 	"asukadb/version"
+	"container/list"
+	log "github.com/sirupsen/logrus"
+	"math"
 	"sync"
 )
 
@@ -12,8 +18,14 @@ type DB struct {
 	mu                           sync.Mutex
 	backgroundWorkFinishedSignal *sync.Cond
 	name                         string
+	opts                         *options.Options
 	seq                          uint64
 	compactionScheduled          bool
+	manualCompaction             *manualCompaction
+	// Live snapshots, the oldest first
+	snapshots                    *list.List
+	writeBufferClient            *writeBufferClient
+	rateLimiterClient            *rateLimiterClient
 	memTable                     *memtable.MemTable
 	iMemTable                    *memtable.MemTable
 	currentVersion               *version.Version
@@ -22,6 +34,15 @@ type DB struct {
 // Standard APIs for AsukaDB
 
 func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.GetWithOptions(key, nil)
+}
+
+// Looks up the key, a nil ro means the default read options.
+func (db *DB) GetWithOptions(key []byte, ro *options.ReadOptions) ([]byte, error) {
+	seq := uint64(math.MaxUint64)
+	if ro != nil && ro.Snapshot != nil {
+		seq = ro.Snapshot.Sequence()
+	}
 	db.mu.Lock()
 	mm := db.memTable
 	imm := db.iMemTable
@@ -29,21 +50,28 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	db.mu.Unlock()
 
 	// search from memtable first
-	value,err := mm.Get(key)
+	value, err := mm.Get(key, seq)
 	if err != common.ErrNotFound {
 		return value, err
 	}
 
 	// then search from immutable memtable
 	if imm != nil {
-		value, err = imm.Get(key)
+		value, err = imm.Get(key, seq)
 		if err != common.ErrNotFound {
 			return value, err
 		}
 	}
 
 	// finally search from sstable, if not found, then we don't contain such a key
-	return curr.Get(key)
+	var stats version.GetStats
+	value, err = curr.Get(key, ro, &stats)
+	db.mu.Lock()
+	if db.currentVersion.UpdateStats(&stats) {
+		db.maybeScheduleCompaction()
+	}
+	db.mu.Unlock()
+	return value, err
 }
 
 func (db *DB) Put(key, value []byte) error {
@@ -70,29 +98,144 @@ func (db *DB) Del(key []byte) error {
 	return nil
 }
 
-func Open(dbName string) *DB {
+// Compacts the keys in [begin,end] down the levels, a nil begin means
+// before all keys and a nil end after all keys.  The memtable is flushed
+// first if it holds keys in the range, then every level overlapping the
+// range but the last one is compacted into the next one, in chunks of
+// bounded size which take turns with the automatic compactions.  Tables
+// are always rewritten, never just moved.  Returns the bytes rewritten.
+func (db *DB) CompactRange(begin, end []byte) (version.CompactionStats, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if memTableOverlaps(db.opts.Comparator, db.memTable, begin, end) ||
+		(db.iMemTable != nil && memTableOverlaps(db.opts.Comparator, db.iMemTable, begin, end)) {
+		db.flushMemTable()
+	}
+
+	// The deepest level holding the range is compacted as well, so that
+	// the deletions and old versions which are no longer needed are
+	// dropped
+	maxLevelWithFiles := 0
+	for level := 1; level < common.NumLevels-1; level++ {
+		if db.currentVersion.OverlapInRange(level, begin, end) {
+			maxLevelWithFiles = level
+		}
+	}
+	var stats version.CompactionStats
+	for level := 0; level <= maxLevelWithFiles; level++ {
+		levelStats, err := db.compactRangeLevel(level, begin, end)
+		stats.Compactions += levelStats.Compactions
+		stats.BytesRead += levelStats.BytesRead
+		stats.BytesWritten += levelStats.BytesWritten
+		if err != nil {
+			return stats, err
+		}
+		log.Infof("CompactRange: level-%d done, %d bytes read, %d bytes written so far",
+			level, stats.BytesRead, stats.BytesWritten)
+	}
+	return stats, nil
+}
+
+// Returns the hit, miss and eviction counters of the block cache.
+func (db *DB) BlockCacheStats() sstable.BlockCacheStats {
+	db.mu.Lock()
+	curr := db.currentVersion
+	db.mu.Unlock()
+
+	return curr.BlockCacheStats()
+}
+
+// Changes the capacity of the block cache at runtime, blocks are evicted
+// right away if the cache holds more than the new capacity.
+func (db *DB) SetBlockCacheCapacity(capacity int64) {
+	db.mu.Lock()
+	curr := db.currentVersion
+	db.mu.Unlock()
+
+	curr.SetBlockCacheCapacity(capacity)
+}
+
+// Returns the counters of the cache of open tables.
+func (db *DB) TableCacheStats() lru.Stats {
+	db.mu.Lock()
+	curr := db.currentVersion
+	db.mu.Unlock()
+
+	return curr.TableCacheStats()
+}
+
+// Returns the number of table files held open by the table cache,
+// including evicted tables which are still used by iterators.
+func (db *DB) NumOpenTableFiles() int64 {
+	db.mu.Lock()
+	curr := db.currentVersion
+	db.mu.Unlock()
+
+	return curr.NumOpenTableFiles()
+}
+
+// Returns the properties of every live table, keyed by table file name.
+func (db *DB) GetPropertiesOfAllTables() (map[string]*sstable.TableProperties, error) {
+	db.mu.Lock()
+	curr := db.currentVersion
+	db.mu.Unlock()
+
+	return curr.GetPropertiesOfAllTables()
+}
+
+// Opens the database with the specified name, a nil opts means
+// the default options.  Fails with common.ErrComparatorMismatch if the
+// database was created with another comparator.
+func Open(dbName string, opts *options.Options) (*DB, error) {
+	if opts == nil {
+		opts = options.New()
+	}
+	if opts.CompactionStyle == options.CompactionStyleUniversal {
+		if err := opts.Universal.Validate(); err != nil {
+			return nil, err
+		}
+	}
 	var db DB
 	db.name = dbName
-	db.memTable = memtable.New()
+	db.opts = opts
+	db.memTable = memtable.New(db.opts.Comparator, db.opts.MemTableRepFactory, db.opts.WriteBufferManager)
 	db.backgroundWorkFinishedSignal = sync.NewCond(&db.mu)
+	db.snapshots = list.New()
 	fileNum := db.ReadCurrentFile()
 	if fileNum > 0 {
-		v, err := version.LoadFromLocal(dbName, fileNum)
+		v, err := version.LoadFromLocal(dbName, fileNum, opts)
 		if err != nil {
-			return nil
+			return nil, err
 		}
 		db.currentVersion = v
 	} else {
-		db.currentVersion = version.New(dbName)
+		db.currentVersion = version.New(dbName, opts)
+	}
+	if opts.WriteBufferManager != nil {
+		db.writeBufferClient = &writeBufferClient{db: &db}
+		opts.WriteBufferManager.Register(db.writeBufferClient)
 	}
-	return &db
+	if opts.RateLimiter != nil {
+		db.rateLimiterClient = &rateLimiterClient{pendingCompactionBytes: db.currentVersion.PendingCompactionBytes()}
+		opts.RateLimiter.Register(db.rateLimiterClient)
+	}
+	return &db, nil
 }
 
 func (db *DB) Close() {
+	if db.writeBufferClient != nil {
+		db.opts.WriteBufferManager.Unregister(db.writeBufferClient)
+	}
+	if db.rateLimiterClient != nil {
+		db.opts.RateLimiter.Unregister(db.rateLimiterClient)
+	}
 	db.mu.Lock()
 	for db.compactionScheduled {
 		db.backgroundWorkFinishedSignal.Wait()
 	}
+	db.memTable.Release()
+	db.currentVersion.Close()
 	db.mu.Unlock()
 }
 
@@ -4,14 +4,23 @@ package db
 import (
 	"asukadb/common"
 	"asukadb/memtable"
+	"asukadb/version"
 	"fmt"
+	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 func (db *DB) makeRoomForWrite() (uint64, error) {
+	if m := db.opts.WriteBufferManager; m != nil && m.ShouldFlush() {
+		// the memtables of all databases sharing the manager are over
+		// budget, this may flush the memtable of another database
+		m.FlushLargest()
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -35,16 +44,37 @@ func (db *DB) makeRoomForWrite() (uint64, error) {
 			db.backgroundWorkFinishedSignal.Wait()
 		} else {
 			// Attempt to switch to a new memtable and trigger compaction of old
-			db.iMemTable = db.memTable
-			db.memTable = memtable.New()
-			// todo: switch log file
-			db.maybeScheduleCompaction()
+			db.switchMemTable()
 		}
 	}
 
 	return db.currentVersion.NextSeq(), nil
 }
 
+// Switches to a new memtable and waits until the old one has been
+// written to a table.
+// REQUIRES: db.mu.Lock()
+func (db *DB) flushMemTable() {
+	for db.iMemTable != nil {
+		db.backgroundWorkFinishedSignal.Wait()
+	}
+	if db.memTable.Empty() {
+		return
+	}
+	db.switchMemTable()
+	for db.iMemTable != nil {
+		db.backgroundWorkFinishedSignal.Wait()
+	}
+}
+
+// REQUIRES: db.mu.Lock(), db.iMemTable == nil
+func (db *DB) switchMemTable() {
+	db.iMemTable = db.memTable
+	db.memTable = memtable.New(db.opts.Comparator, db.opts.MemTableRepFactory, db.opts.WriteBufferManager)
+	// todo: switch log file
+	db.maybeScheduleCompaction()
+}
+
 // REQUIRES: db.mu.Lock()
 func (db *DB) maybeScheduleCompaction() {
 	if db.compactionScheduled {
@@ -59,15 +89,44 @@ func (db *DB) backgroundCall() {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	db.backgroundCompaction()
+	manual := db.manualCompaction != nil && !db.manualCompaction.done
+	err := db.backgroundCompaction()
+	if err != nil {
+		// Wait a little bit before retrying in case this is an
+		// environmental problem, the memtable is kept until then
+		log.Errorf("Flushing the memtable failed: %v", err)
+		db.backgroundWorkFinishedSignal.Broadcast()
+		db.mu.Unlock()
+		time.Sleep(time.Second)
+		db.mu.Lock()
+	}
 	db.compactionScheduled = false
+	if manual || err != nil {
+		// The automatic compactions were skipped for the manual one
+		db.maybeScheduleCompaction()
+	}
 	db.backgroundWorkFinishedSignal.Broadcast()
 }
 
+// Returns the error of the flush of the immutable memtable, the version is
+// not changed then.
 // REQUIRES: db.mu.Lock()
-func (db *DB) backgroundCompaction() {
+func (db *DB) backgroundCompaction() error {
 	base := db.currentVersion.Copy()
 	imm := db.iMemTable
+	manual := db.manualCompaction
+	if manual != nil && manual.done {
+		// Scheduled before the waiter of the finished manual compaction
+		// woke up, don't compact its last range again
+		db.manualCompaction = nil
+		manual = nil
+	}
+	snapshots := db.snapshotSequences()
+	var level int
+	var begin, end []byte
+	if manual != nil {
+		level, begin, end = manual.level, manual.begin, manual.end
+	}
 
 	// Release mutex while we're actually doing the compaction work
 	db.mu.Unlock()
@@ -75,19 +134,95 @@ func (db *DB) backgroundCompaction() {
 	// Minor compaction
 	if imm != nil {
 		// Save the contents of the memtable as a new Table
-		base.WriteLevel0Table(imm)
+		if err := base.WriteLevel0Table(imm, snapshots); err != nil {
+			db.mu.Lock()
+			return err
+		}
 	}
 
-	// Major compaction
-	for base.DoCompactionWork() {
-		base.Log()
+	var stats version.CompactionStats
+	var next []byte
+	var err error
+	if manual != nil {
+		// Manual compaction, one chunk at a time so that the automatic
+		// compactions are not held back for too long
+		next, err = base.CompactRange(level, begin, end, snapshots, &stats)
+		log.Infof("Manual compaction at level-%d from %s .. %s; will stop at %s, %d bytes written",
+			level, keyString(begin, "(begin)"), keyString(end, "(end)"), keyString(next, "(end)"), stats.BytesWritten)
+	} else {
+		// Major compaction
+		for base.DoCompactionWork(snapshots) {
+			base.Log()
+		}
 	}
 
 	descriptorNumber, _ := base.Save()
 	db.SetCurrentFile(descriptorNumber)
 	db.mu.Lock()
+	if imm != nil {
+		imm.Release()
+	}
 	db.iMemTable = nil
+	// writes went on while the lock was released
+	base.SetLastSequence(db.currentVersion.LastSequence())
 	db.currentVersion = base
+	if db.rateLimiterClient != nil {
+		atomic.StoreUint64(&db.rateLimiterClient.pendingCompactionBytes, base.PendingCompactionBytes())
+	}
+	if manual != nil {
+		manual.stats.Compactions += stats.Compactions
+		manual.stats.BytesRead += stats.BytesRead
+		manual.stats.BytesWritten += stats.BytesWritten
+		if err != nil || next == nil {
+			manual.done = true
+			manual.err = err
+		} else {
+			manual.begin = next
+		}
+	}
+	return nil
+}
+
+// A compaction of a key range requested by CompactRange
+type manualCompaction struct {
+	level int
+	// nil means the beginning or the end of the key space
+	begin, end []byte
+	done       bool
+	err        error
+	stats      version.CompactionStats
+}
+
+// Compacts the files of level overlapping [begin,end] into the next level.
+// REQUIRES: db.mu.Lock()
+func (db *DB) compactRangeLevel(level int, begin, end []byte) (version.CompactionStats, error) {
+	// Wait for any other manual compaction to finish
+	for db.manualCompaction != nil {
+		db.backgroundWorkFinishedSignal.Wait()
+	}
+	manual := &manualCompaction{level: level, begin: begin, end: end}
+	db.manualCompaction = manual
+	for !manual.done {
+		// The running compaction may have started before the manual one
+		// was set, schedule another run
+		db.maybeScheduleCompaction()
+		db.backgroundWorkFinishedSignal.Wait()
+	}
+	if db.manualCompaction == manual {
+		// the background compaction may have cleared it already and
+		// another manual compaction started since
+		db.manualCompaction = nil
+	}
+	db.backgroundWorkFinishedSignal.Broadcast()
+	return manual.stats, manual.err
+}
+
+// Returns the key quoted for the log, or bound if it is nil.
+func keyString(key []byte, bound string) string {
+	if key == nil {
+		return bound
+	}
+	return fmt.Sprintf("'%s'", key)
 }
 
 func (db *DB) SetCurrentFile(descriptorNumber uint64) {
@@ -107,3 +242,34 @@ func (db *DB) ReadCurrentFile() uint64 {
 	}
 	return descriptorNumber
 }
+
+// Lets a WriteBufferManager flush the memtables of the database.
+type writeBufferClient struct {
+	db *DB
+}
+
+func (client *writeBufferClient) MutableMemTableUsage() int64 {
+	client.db.mu.Lock()
+	defer client.db.mu.Unlock()
+	return int64(client.db.memTable.ApproximateMemoryUsage())
+}
+
+func (client *writeBufferClient) ScheduleFlush() {
+	db := client.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.iMemTable == nil && !db.memTable.Empty() {
+		db.switchMemTable()
+	}
+}
+
+// Reports the compaction debt of the database to an auto-tuned rate
+// limiter.  The limiter calls it with its lock held, so it doesn't take
+// the lock of the database.
+type rateLimiterClient struct {
+	pendingCompactionBytes uint64
+}
+
+func (client *rateLimiterClient) PendingCompactionBytes() uint64 {
+	return atomic.LoadUint64(&client.pendingCompactionBytes)
+}
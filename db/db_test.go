@@ -11,7 +11,7 @@ import (
 var r = rand.New(rand.NewSource(time.Now().UnixNano()))
 
 func TestDB(t *testing.T) {
-	db := Open("ASUKA")
+	db := openDB(t, "ASUKA", nil)
 	for i := 0; i < 99999; i++ {
 		db.Put([]byte(strconv.FormatUint(r.Uint64(), 10)), []byte(strconv.FormatUint(r.Uint64(), 10)))
 	}
@@ -25,7 +25,7 @@ func TestDB(t *testing.T) {
 	}
 	db.Close()
 
-	db_ := Open("ASUKA")
+	db_ := openDB(t, "ASUKA", nil)
 	value, err = db_.Get([]byte("zzl"))
 	if err != nil {
 		t.Fail()
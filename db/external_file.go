@@ -0,0 +1,187 @@
+// Created on 2021/4/9 by @zzl
+package db
+
+import (
+	"asukadb/common"
+	"asukadb/memtable"
+	"asukadb/options"
+	"asukadb/sstable"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sort"
+)
+
+type externalFile struct {
+	path          string
+	fileSize      uint64
+	formatVersion uint32
+	smallest      []byte
+	largest       []byte
+}
+
+// Loads tables written by sstable.SstFileWriter into the database.  Every
+// entry of the files gets the same new sequence number, so the files must
+// not overlap each other.  The files are installed in a single version,
+// either all of them become visible or none does.
+func (db *DB) IngestExternalFiles(paths []string, opts *options.IngestExternalFileOptions) error {
+	if opts == nil {
+		opts = &options.IngestExternalFileOptions{}
+	}
+	files := make([]*externalFile, 0, len(paths))
+	for _, path := range paths {
+		f, err := db.readExternalFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	cmp := db.opts.Comparator
+	sort.Slice(files, func(i, j int) bool {
+		return cmp.Compare(files[i].smallest, files[j].smallest) < 0
+	})
+	for i := 1; i < len(files); i++ {
+		if cmp.Compare(files[i-1].largest, files[i].smallest) >= 0 {
+			return common.ErrOverlappingFiles
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Background compaction installs the version it started from, so wait
+	// for it before installing ours.  The ingested entries are newer than
+	// anything in the memtables, flush them first if they hold some of the
+	// keys, otherwise the older values in memory would still be returned.
+	// Writes may go on while waiting, so check both again after every wait.
+	for {
+		if db.compactionScheduled {
+			db.backgroundWorkFinishedSignal.Wait()
+		} else if db.memTablesOverlap(files) {
+			db.flushMemTable()
+		} else {
+			break
+		}
+	}
+
+	v := db.currentVersion.Copy()
+	seq := v.NextSeq()
+	// Until the version is saved, the files in the database are links or
+	// copies of the external files, so a failure leaves the caller's
+	// files in place.  Moved files are only removed once saved.
+	var installed []string
+	removeInstalled := func() {
+		for _, name := range installed {
+			os.Remove(name)
+		}
+	}
+	for _, f := range files {
+		number := v.NewFileNumber()
+		fileName := common.GetTableFileName(db.name, number)
+		err := installExternalFile(f.path, fileName, opts.MoveFiles)
+		if err == nil {
+			installed = append(installed, fileName)
+			err = sstable.SetGlobalSeq(fileName, seq, db.opts)
+		}
+		if err != nil {
+			os.Remove(fileName)
+			removeInstalled()
+			return err
+		}
+
+		smallest := common.NewInternalKey(seq, common.TypeValue, f.smallest, nil)
+		largest := common.NewInternalKey(seq, common.TypeValue, f.largest, nil)
+		level := v.AddExternalFile(number, f.fileSize, f.formatVersion, smallest, largest)
+		log.Infof("Ingested %s as table %d at level %d", f.path, number, level)
+	}
+
+	descriptorNumber, err := v.Save()
+	if err != nil {
+		os.Remove(common.GetDescriptorFileName(db.name, descriptorNumber))
+		removeInstalled()
+		return err
+	}
+	db.SetCurrentFile(descriptorNumber)
+	db.currentVersion = v
+	if opts.MoveFiles {
+		for _, f := range files {
+			os.Remove(f.path)
+		}
+	}
+	return nil
+}
+
+// REQUIRES: db.mu.Lock()
+func (db *DB) memTablesOverlap(files []*externalFile) bool {
+	cmp := db.opts.Comparator
+	for _, f := range files {
+		if memTableOverlaps(cmp, db.memTable, f.smallest, f.largest) ||
+			(db.iMemTable != nil && memTableOverlaps(cmp, db.iMemTable, f.smallest, f.largest)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *DB) readExternalFile(path string) (*externalFile, error) {
+	table, err := sstable.Open(path, db.opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer table.Close()
+	if table.Properties().ExternalVersion == 0 {
+		return nil, common.ErrNotExternalFile
+	}
+
+	var f externalFile
+	f.path = path
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	f.fileSize = uint64(stat.Size())
+	f.formatVersion = table.FormatVersion()
+	it := table.NewIterator(nil)
+	it.SeekToFirst()
+	if !it.Valid() {
+		return nil, common.ErrEmptyFile
+	}
+	f.smallest = append([]byte(nil), it.Key()...)
+	it.SeekToLast()
+	f.largest = append([]byte(nil), it.Key()...)
+	return &f, nil
+}
+
+// Returns true iff the memtable holds a key in [smallest,largest], a nil
+// smallest means before all keys and a nil largest after all keys.
+func memTableOverlaps(cmp common.Comparator, memTable *memtable.MemTable, smallest, largest []byte) bool {
+	it := memTable.NewIterator()
+	if smallest == nil {
+		it.SeekToFirst()
+	} else {
+		it.Seek(common.LookupKey(smallest))
+	}
+	return it.Valid() && (largest == nil || cmp.Compare(it.InternalKey().UserKey, largest) <= 0)
+}
+
+func installExternalFile(src, dst string, move bool) error {
+	if move && os.Link(src, dst) == nil {
+		return nil
+	}
+	// fall back to copying, e.g. when the file is on another device
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+	return out.Sync()
+}
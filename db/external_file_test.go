@@ -0,0 +1,209 @@
+// Created on 2021/4/9 by @zzl
+package db
+
+import (
+	"asukadb/common"
+	"asukadb/options"
+	"asukadb/sstable"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func removeDBFiles(dbName string) {
+	files, _ := filepath.Glob(dbName + "*")
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+// Opens the database or fails the test.
+func openDB(t *testing.T, dbName string, opts *options.Options) *DB {
+	db, err := Open(dbName, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func writeExternalFile(t *testing.T, fileName string, begin, end int, value string) {
+	writer, err := sstable.NewSstFileWriter(fileName, options.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := begin; i < end; i++ {
+		if err = writer.Put([]byte(fmt.Sprintf("key%06d", i)), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = writer.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestExternalFiles(t *testing.T) {
+	removeDBFiles("INGEST")
+	defer removeDBFiles("INGEST")
+
+	db := openDB(t, "INGEST", nil)
+	db.Put([]byte("key000005"), []byte("old"))
+	db.Put([]byte("other"), []byte("kept"))
+
+	writeExternalFile(t, "INGEST-external-1", 0, 100, "a")
+	writeExternalFile(t, "INGEST-external-2", 100, 200, "b")
+	writeExternalFile(t, "INGEST-external-3", 150, 250, "c")
+
+	err := db.IngestExternalFiles([]string{"INGEST-external-2", "INGEST-external-3"}, nil)
+	if err != common.ErrOverlappingFiles {
+		t.Fatalf("overlapping files must be rejected, got %v", err)
+	}
+	err = db.IngestExternalFiles([]string{"INGEST-external-2", "INGEST-external-1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key%06d", i)))
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		want := "a"
+		if i >= 100 {
+			want = "b"
+		}
+		if string(value) != want {
+			t.Fatalf("key %d: got %s, want %s", i, value, want)
+		}
+	}
+	if value, err := db.Get([]byte("other")); err != nil || string(value) != "kept" {
+		t.Fatal(err, string(value))
+	}
+	db.Close()
+
+	db = openDB(t, "INGEST", nil)
+	defer db.Close()
+	value, err := db.Get([]byte("key000150"))
+	if err != nil || string(value) != "b" {
+		t.Fatal(err, string(value))
+	}
+	props, err := db.GetPropertiesOfAllTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(props) != 3 {
+		t.Fatalf("expected 3 tables, got %d", len(props))
+	}
+}
+
+func TestIngestExternalFilesComparator(t *testing.T) {
+	removeDBFiles("INGESTCMP")
+	defer removeDBFiles("INGESTCMP")
+
+	opts := options.New()
+	opts.Comparator = reverseComparator{}
+	db := openDB(t, "INGESTCMP", opts)
+	defer db.Close()
+
+	// the keys of the file follow the comparator of the database
+	writer, err := sstable.NewSstFileWriter("INGESTCMP-external", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 99; i >= 0; i-- {
+		if err = writer.Put([]byte(fmt.Sprintf("key%06d", i)), []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = writer.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.IngestExternalFiles([]string{"INGESTCMP-external"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if value, err := db.Get([]byte(fmt.Sprintf("key%06d", i))); err != nil || string(value) != "a" {
+			t.Fatal(i, err, string(value))
+		}
+	}
+}
+
+func TestIngestExternalFilesMoveFailure(t *testing.T) {
+	removeDBFiles("INGESTMV")
+	defer removeDBFiles("INGESTMV")
+
+	db := openDB(t, "INGESTMV", nil)
+	defer db.Close()
+	writeExternalFile(t, "INGESTMV-external", 0, 100, "a")
+
+	// directories in place of the next descriptors make saving the version fail
+	var blocked []string
+	for i := uint64(1); i < 100; i++ {
+		name := common.GetDescriptorFileName("INGESTMV", i)
+		if os.Mkdir(name, 0755) == nil {
+			blocked = append(blocked, name)
+		}
+	}
+	opts := &options.IngestExternalFileOptions{MoveFiles: true}
+	if err := db.IngestExternalFiles([]string{"INGESTMV-external"}, opts); err == nil {
+		t.Fatal("ingestion must fail when the version cannot be saved")
+	}
+	if _, err := os.Stat("INGESTMV-external"); err != nil {
+		t.Fatal("the external file must be kept when ingestion fails:", err)
+	}
+	if _, err := db.Get([]byte("key000000")); err != common.ErrNotFound {
+		t.Fatal("a failed ingestion must not be visible:", err)
+	}
+	for _, name := range blocked {
+		os.Remove(name)
+	}
+
+	if err := db.IngestExternalFiles([]string{"INGESTMV-external"}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("INGESTMV-external"); !os.IsNotExist(err) {
+		t.Fatal("a moved file must be removed once ingested:", err)
+	}
+	if value, err := db.Get([]byte("key000050")); err != nil || string(value) != "a" {
+		t.Fatal(err, string(value))
+	}
+}
+
+func TestIngestExternalFilesConcurrentWrites(t *testing.T) {
+	removeDBFiles("INGESTCW")
+	defer removeDBFiles("INGESTCW")
+
+	db := openDB(t, "INGESTCW", nil)
+	defer db.Close()
+	writeExternalFile(t, "INGESTCW-external", 0, 100, "a")
+	db.Put([]byte("key000005"), []byte("old"))
+
+	// the writes fill up memtables and schedule compactions while the
+	// file is being ingested
+	value := make([]byte, 1024)
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 8192; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("other%06d", i)), value); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	if err := db.IngestExternalFiles([]string{"INGESTCW-external"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if value, err := db.Get([]byte(fmt.Sprintf("key%06d", i))); err != nil || string(value) != "a" {
+			t.Fatal(i, err, string(value))
+		}
+	}
+	for i := 0; i < 8192; i += 512 {
+		if _, err := db.Get([]byte(fmt.Sprintf("other%06d", i))); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Created on 2021/5/5 by @zzl
+package db
+
+import (
+	"asukadb/options"
+	"asukadb/ratelimit"
+	"fmt"
+	"testing"
+)
+
+func TestRateLimiter(t *testing.T) {
+	removeDBFiles("RATE_LIMITER")
+	defer removeDBFiles("RATE_LIMITER")
+
+	limiter := ratelimit.NewRateLimiter(64 << 20)
+	opts := options.New()
+	opts.RateLimiter = limiter
+	opts.RateLimitCompactionReads = true
+	db := openDB(t, "RATE_LIMITER", opts)
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		db.Put([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	stats, err := db.CompactRange(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the flush is charged at high priority, the compaction at low priority
+	if limiter.TotalBytesThrough(ratelimit.PriorityHigh) == 0 {
+		t.Fatal("the flush was not rate limited")
+	}
+	if low := limiter.TotalBytesThrough(ratelimit.PriorityLow); low < int64(stats.BytesWritten) {
+		t.Fatalf("%d bytes charged at low priority, %d bytes written by compactions", low, stats.BytesWritten)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if value, err := db.Get(key); err != nil || string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("%s: %v %s", key, err, value)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Created on 2021/5/2 by @zzl
+package db
+
+import "container/list"
+
+// A consistent read-only view of the database, set it in
+// options.ReadOptions to read from it.
+type Snapshot struct {
+	seq  uint64
+	elem *list.Element
+}
+
+func (snapshot *Snapshot) Sequence() uint64 {
+	return snapshot.seq
+}
+
+// Returns a handle to the current state of the database.  Reads with the
+// snapshot in their ReadOptions see the database as it was when the
+// snapshot was taken.  The caller must call ReleaseSnapshot once it no
+// longer needs it, compactions preserve the entries it sees until then.
+func (db *DB) GetSnapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	snapshot := &Snapshot{seq: db.currentVersion.LastSequence()}
+	snapshot.elem = db.snapshots.PushBack(snapshot)
+	return snapshot
+}
+
+func (db *DB) ReleaseSnapshot(snapshot *Snapshot) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.snapshots.Remove(snapshot.elem)
+}
+
+// Returns the sequence numbers of the live snapshots in increasing order.
+// REQUIRES: db.mu.Lock()
+func (db *DB) snapshotSequences() []uint64 {
+	var seqs []uint64
+	for e := db.snapshots.Front(); e != nil; e = e.Next() {
+		seqs = append(seqs, e.Value.(*Snapshot).seq)
+	}
+	return seqs
+}
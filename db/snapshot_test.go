@@ -0,0 +1,69 @@
+// Created on 2021/5/2 by @zzl
+package db
+
+import (
+	"asukadb/common"
+	"asukadb/options"
+	"fmt"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	removeDBFiles("SNAPSHOT")
+	defer removeDBFiles("SNAPSHOT")
+
+	db := openDB(t, "SNAPSHOT", nil)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("old"))
+	}
+	snapshot := db.GetSnapshot()
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("new"))
+		} else {
+			db.Del([]byte(fmt.Sprintf("key%03d", i)))
+		}
+	}
+
+	ro := options.NewReadOptions()
+	ro.Snapshot = snapshot
+	check := func(when string) {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			if value, err := db.GetWithOptions(key, ro); err != nil || string(value) != "old" {
+				t.Fatalf("%s: %s in snapshot: %v %s", when, key, err, value)
+			}
+			value, err := db.Get(key)
+			if i%2 == 0 && (err != nil || string(value) != "new") {
+				t.Fatalf("%s: %s: %v %s", when, key, err, value)
+			}
+			if i%2 == 1 && err != common.ErrDeletion && err != common.ErrNotFound {
+				t.Fatalf("%s: %s should be deleted: %v", when, key, err)
+			}
+		}
+	}
+	check("in memory")
+	// compactions keep the old values while the snapshot is alive
+	if _, err := db.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	check("compacted")
+
+	db.ReleaseSnapshot(snapshot)
+	stats, err := db.CompactRange(nil, nil)
+	if err != nil || stats.BytesWritten == 0 {
+		t.Fatal(err, stats)
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		value, err := db.Get(key)
+		if i%2 == 0 && (err != nil || string(value) != "new") {
+			t.Fatalf("%s: %v %s", key, err, value)
+		}
+		// nothing is left of the deleted keys
+		if i%2 == 1 && err != common.ErrNotFound {
+			t.Fatalf("%s: got %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Created on 2021/5/6 by @zzl
+package db
+
+import (
+	"asukadb/common"
+	"asukadb/options"
+	"testing"
+)
+
+func TestUniversalCompactionOptions(t *testing.T) {
+	removeDBFiles("UNIVERSAL")
+	defer removeDBFiles("UNIVERSAL")
+
+	for _, invalid := range []func(*options.UniversalCompactionOptions){
+		func(u *options.UniversalCompactionOptions) { u.NumRunsCompactionTrigger = 1 },
+		func(u *options.UniversalCompactionOptions) { u.NumRunsCompactionTrigger = common.L0SlowdownWritesTrigger },
+		func(u *options.UniversalCompactionOptions) { u.MinMergeWidth = 1 },
+	} {
+		opts := options.New()
+		opts.CompactionStyle = options.CompactionStyleUniversal
+		invalid(&opts.Universal)
+		if _, err := Open("UNIVERSAL", opts); err != common.ErrInvalidOptions {
+			t.Fatalf("%+v should be rejected, got %v", opts.Universal, err)
+		}
+	}
+
+	opts := options.New()
+	opts.CompactionStyle = options.CompactionStyleUniversal
+	db := openDB(t, "UNIVERSAL", opts)
+	db.Close()
+}
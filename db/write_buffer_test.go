@@ -0,0 +1,62 @@
+// Created on 2021/4/27 by @zzl
+package db
+
+import (
+	"asukadb/lru"
+	"asukadb/memtable"
+	"asukadb/options"
+	"fmt"
+	"testing"
+)
+
+func TestWriteBufferManager(t *testing.T) {
+	removeDBFiles("WBM1")
+	removeDBFiles("WBM2")
+	defer removeDBFiles("WBM1")
+	defer removeDBFiles("WBM2")
+
+	cache := lru.NewCache(8<<20, 0, nil)
+	manager := memtable.NewWriteBufferManager(512<<10, cache)
+	opts := options.New()
+	opts.BlockCache = cache
+	opts.WriteBufferManager = manager
+	db1 := openDB(t, "WBM1", opts)
+	db2 := openDB(t, "WBM2", opts)
+
+	value := make([]byte, 1024)
+	for i := 0; i < 400; i++ {
+		db1.Put([]byte(fmt.Sprintf("key%06d", i)), value)
+	}
+	if manager.MemoryUsage() == 0 || manager.CacheCharge() < manager.MemoryUsage() {
+		t.Fatalf("memtables should be charged: usage %d, charged %d", manager.MemoryUsage(), manager.CacheCharge())
+	}
+	if stats := cache.Stats(); stats.Pinned != manager.CacheCharge() {
+		t.Fatalf("got %d bytes pinned in the cache", stats.Pinned)
+	}
+
+	// going over the budget flushes the memtable of db1, the largest one
+	for i := 0; i < 200; i++ {
+		db2.Put([]byte(fmt.Sprintf("key%06d", i)), value)
+	}
+	db1.mu.Lock()
+	for db1.compactionScheduled {
+		db1.backgroundWorkFinishedSignal.Wait()
+	}
+	empty := db1.memTable.Empty()
+	db1.mu.Unlock()
+	if !empty {
+		t.Fatal("the memtable of db1 should be flushed")
+	}
+	if manager.MemoryUsage() > manager.BufferSize() {
+		t.Fatalf("got %d bytes of memtables", manager.MemoryUsage())
+	}
+	if v, err := db1.Get([]byte("key000123")); err != nil || len(v) != len(value) {
+		t.Fatal(err)
+	}
+
+	db1.Close()
+	db2.Close()
+	if manager.MemoryUsage() != 0 || manager.CacheCharge() != 0 {
+		t.Fatalf("usage %d, charged %d after close", manager.MemoryUsage(), manager.CacheCharge())
+	}
+}
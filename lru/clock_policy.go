@@ -0,0 +1,74 @@
+// Created on 2021/4/20 by @zzl
+package lru
+
+import "container/list"
+
+// All entries of the cache are kept on a circle.  A lookup sets the
+// reference bit of the entry, the hand sweeps over the circle clearing
+// the bits and stops at the first unpinned entry without one.  New
+// entries are inserted right behind the hand, so they are the last to be
+// visited by the sweep.
+type clockPolicy struct {
+	circle *list.List
+	hand   *list.Element
+}
+
+func newClockPolicy() *clockPolicy {
+	return &clockPolicy{circle: list.New()}
+}
+
+func (p *clockPolicy) setCapacity(capacity int64) {}
+
+func (p *clockPolicy) insert(h *Handle) {
+	h.referenced = false
+	if p.hand == nil {
+		h.elem = p.circle.PushBack(h)
+		p.hand = h.elem
+	} else {
+		h.elem = p.circle.InsertBefore(h, p.hand)
+	}
+}
+
+func (p *clockPolicy) access(h *Handle) {
+	h.referenced = true
+}
+
+// Pinned entries stay on the circle, the sweep skips them.
+func (p *clockPolicy) pin(h *Handle) {}
+
+func (p *clockPolicy) unpin(h *Handle) {}
+
+func (p *clockPolicy) remove(h *Handle) {
+	if p.hand == h.elem {
+		p.hand = p.next(h.elem)
+		if p.hand == h.elem {
+			p.hand = nil
+		}
+	}
+	p.circle.Remove(h.elem)
+	h.elem = nil
+}
+
+func (p *clockPolicy) victim() *Handle {
+	// two rounds clear all reference bits, what is left is pinned
+	for i := 0; p.hand != nil && i < 2*p.circle.Len(); i++ {
+		h := p.hand.Value.(*Handle)
+		p.hand = p.next(p.hand)
+		if h.pinned() {
+			continue
+		}
+		if h.referenced {
+			h.referenced = false
+			continue
+		}
+		return h
+	}
+	return nil
+}
+
+func (p *clockPolicy) next(e *list.Element) *list.Element {
+	if next := e.Next(); next != nil {
+		return next
+	}
+	return p.circle.Front()
+}
@@ -2,100 +2,252 @@
 package lru
 
 import (
-	"container/list"
-	"errors"
+	"fmt"
+	"sync/atomic"
 )
 
-type EvictCallback func(key interface{}, value interface{})
+// Called once an entry has left the cache and all of its handles are
+// released.  It never runs while a shard lock is held.
+type EvictCallback func(key string, value interface{})
 
-// Not thread-safe
-type Cache struct {
-	size      int
-	evictList *list.List
-	mapping   map[interface{}]*list.Element
-	onEvict   EvictCallback
+// Number of shard bits used when the caller passes a negative value
+const DefaultNumShardBits = 4
+
+// Share of the capacity reserved for high priority entries by PolicyLRU
+const DefaultHighPriPoolRatio = 0.5
+
+// Eviction policies of a Cache
+type Policy int
+
+const (
+	// Least recently used, new entries are inserted at the midpoint of the
+	// list and only move into the high priority pool once they are hit, so
+	// a scan can't flush the entries which are used repeatedly.
+	PolicyLRU Policy = iota
+	// Approximates LRU with a reference bit per entry and a clock hand
+	// sweeping over all entries.
+	PolicyClock
+	// A small LRU window in front of a segmented LRU, entries leaving the
+	// window are only admitted if they are used more often than the entry
+	// they would push out, as estimated by a count-min sketch.
+	PolicyTinyLFU
+)
+
+func (policy Policy) String() string {
+	switch policy {
+	case PolicyLRU:
+		return "LRU"
+	case PolicyClock:
+		return "CLOCK"
+	case PolicyTinyLFU:
+		return "W-TinyLFU"
+	default:
+		return fmt.Sprintf("Policy(%d)", int(policy))
+	}
+}
+
+// Priority of an entry, PolicyLRU keeps high priority entries in the high
+// priority pool.  The other policies ignore it.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityHigh
+)
+
+// Counters of a Cache, summed over all shards
+type Stats struct {
+	Policy    Policy
+	Hits      uint64
+	Misses    uint64
+	Inserts   uint64
+	Evictions uint64 // Entries pushed out to stay within the capacity
+	Usage     int64  // Total charge of the entries in the cache
+	Pinned    int64  // Charge of the entries referenced by a handle
+	Capacity  int64
 }
 
-func NewCache(size int, onEvict EvictCallback) (*Cache, error) {
-	if size <= 0 {
-		return nil, errors.New("must provide a positive size")
+// Returns the share of lookups which found their entry.
+func (stats Stats) HitRatio() float64 {
+	if stats.Hits+stats.Misses == 0 {
+		return 0
 	}
-	c := &Cache{
-		size:      size,
-		evictList: list.New(),
-		mapping:     make(map[interface{}]*list.Element),
-		onEvict:   onEvict,
+	return float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+}
+
+func (stats Stats) String() string {
+	return fmt.Sprintf("%v: hits=%d misses=%d hit ratio=%.3f inserts=%d evictions=%d usage=%d/%d pinned=%d",
+		stats.Policy, stats.Hits, stats.Misses, stats.HitRatio(), stats.Inserts, stats.Evictions,
+		stats.Usage, stats.Capacity, stats.Pinned)
+}
+
+// Cache maps keys to values, each entry carries a charge and the cache
+// evicts entries which are not pinned by a handle once their total charge
+// exceeds the capacity.  Implementations are safe for concurrent use.
+type Cache interface {
+	// Inserts a mapping from key to value with the given charge, replacing
+	// any existing entry of the key.  Returns a handle to the new entry,
+	// the caller must call Release once it no longer needs it.
+	Insert(key string, value interface{}, charge int64) *Handle
+	InsertWithPriority(key string, value interface{}, charge int64, priority Priority) *Handle
+	// Returns a handle to the entry of key, or nil if there is none.  The
+	// entry stays pinned until the handle is released.
+	Lookup(key string) *Handle
+	// Releases a handle returned by Insert or Lookup.
+	Release(h *Handle)
+	// Removes the entry of key from the cache.  Its eviction callback runs
+	// once all outstanding handles are released.
+	Erase(key string)
+	// Removes all entries which are not pinned.
+	Prune()
+	// Removes all entries, pinned entries are freed when released.
+	Purge()
+	// Changes the capacity, evicting entries right away if the cache is
+	// over the new capacity.
+	SetCapacity(capacity int64)
+	// Returns a new id, clients sharing the cache use it to partition the
+	// key space.
+	NewId() uint64
+	Stats() Stats
+}
+
+type Config struct {
+	Policy   Policy
+	Capacity int64
+	// The cache is split into 2^NumShardBits shards, each with its own lock
+	// and an equal share of the capacity.  Negative means the default.
+	NumShardBits int
+	// Only used by PolicyLRU, zero means the default
+	HighPriPoolRatio float64
+}
+
+// Returns an LRU cache of 2^numShardBits shards sharing the capacity.
+func NewCache(capacity int64, numShardBits int, onEvict EvictCallback) Cache {
+	return New(Config{Policy: PolicyLRU, Capacity: capacity, NumShardBits: numShardBits}, onEvict)
+}
+
+func New(config Config, onEvict EvictCallback) Cache {
+	numShardBits := config.NumShardBits
+	if numShardBits < 0 {
+		numShardBits = DefaultNumShardBits
 	}
-	return c, nil
+	highPriPoolRatio := config.HighPriPoolRatio
+	if highPriPoolRatio <= 0 {
+		highPriPoolRatio = DefaultHighPriPoolRatio
+	}
+	numShards := 1 << uint(numShardBits)
+	c := &shardedCache{
+		policy:  config.Policy,
+		shards:  make([]shard, numShards),
+		mask:    uint32(numShards - 1),
+		onEvict: onEvict,
+	}
+	for i := range c.shards {
+		var p policy
+		switch config.Policy {
+		case PolicyClock:
+			p = newClockPolicy()
+		case PolicyTinyLFU:
+			p = newTinyLFUPolicy()
+		default:
+			p = newLRUPolicy(highPriPoolRatio)
+		}
+		c.shards[i].init(p)
+	}
+	c.SetCapacity(config.Capacity)
+	return c
+}
+
+type shardedCache struct {
+	policy  Policy
+	shards  []shard
+	mask    uint32
+	lastId  uint64
+	onEvict EvictCallback
+}
+
+func (c *shardedCache) Insert(key string, value interface{}, charge int64) *Handle {
+	return c.InsertWithPriority(key, value, charge, PriorityLow)
+}
+
+func (c *shardedCache) InsertWithPriority(key string, value interface{}, charge int64, priority Priority) *Handle {
+	h := &Handle{key: key, value: value, charge: charge, hash: hashKey(key), priority: priority}
+	c.evict(c.shard(h.hash).insert(h))
+	return h
 }
 
-type Entry struct {
-	key interface{}
-	value interface{}
+func (c *shardedCache) Lookup(key string) *Handle {
+	return c.shard(hashKey(key)).lookup(key)
 }
 
-// Returns true if eviction occurred.
-func (c *Cache) Add(key, value interface{}) bool {
-	// Check the existence
-	if entry, ok := c.mapping[key]; ok {
-		c.evictList.MoveToFront(entry)
-		entry.Value.(*Entry).value = value
-		return false
+func (c *shardedCache) Release(h *Handle) {
+	c.evict(c.shard(h.hash).release(h))
+}
+
+func (c *shardedCache) Erase(key string) {
+	c.evict(c.shard(hashKey(key)).erase(key))
+}
+
+func (c *shardedCache) Prune() {
+	for i := range c.shards {
+		c.evict(c.shards[i].prune())
 	}
+}
 
-	// Add new entry
-	entry := Entry{
-		key:   key,
-		value: value,
+func (c *shardedCache) Purge() {
+	for i := range c.shards {
+		c.evict(c.shards[i].purge())
 	}
-	e := c.evictList.PushFront(entry)
-	c.mapping[key] = e
+}
 
-	// Check the eviction
-	if c.evictList.Len() > c.size {
-		c.removeOldest()
-		return true
+func (c *shardedCache) SetCapacity(capacity int64) {
+	n := int64(len(c.shards))
+	perShard := (capacity + n - 1) / n
+	for i := range c.shards {
+		c.evict(c.shards[i].setCapacity(perShard))
 	}
+}
 
-	return false
+func (c *shardedCache) NewId() uint64 {
+	return atomic.AddUint64(&c.lastId, 1)
 }
 
-// Returns value for the key, false if not found.
-func (c *Cache) Get(key interface{}) (interface{}, bool) {
-	if entry, ok := c.mapping[key]; ok {
-		c.evictList.MoveToFront(entry)
-		if entry.Value.(*Entry) != nil {
-			return entry.Value.(*Entry).value, true
-		} else {
-			return nil, false
-		}
+func (c *shardedCache) Stats() Stats {
+	stats := Stats{Policy: c.policy}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Hits += s.stats.Hits
+		stats.Misses += s.stats.Misses
+		stats.Inserts += s.stats.Inserts
+		stats.Evictions += s.stats.Evictions
+		stats.Usage += s.usage
+		stats.Pinned += s.pinned
+		stats.Capacity += s.capacity
+		s.mu.Unlock()
 	}
-	return nil, false
+	return stats
 }
 
-// Returns true if removed successfully
-func (c *Cache) Remove(key interface{}) bool {
-	if entry, ok := c.mapping[key]; ok {
-		c.removeElement(entry)
-		return true
-	}
-	return false
+func (c *shardedCache) shard(hash uint32) *shard {
+	return &c.shards[hash&c.mask]
 }
 
-// Removes the oldest item from the cache.
-func (c *Cache) removeOldest() {
-	ent := c.evictList.Back()
-	if ent != nil {
-		c.removeElement(ent)
+func (c *shardedCache) evict(handles []*Handle) {
+	if c.onEvict == nil {
+		return
+	}
+	for _, h := range handles {
+		c.onEvict(h.key, h.value)
 	}
 }
 
-// Removes a given list element from the cache
-func (c *Cache) removeElement(e *list.Element) {
-	c.evictList.Remove(e)
-	kv := e.Value.(*Entry)
-	delete(c.mapping, kv.key)
-	if c.onEvict != nil {
-		c.onEvict(kv.key, kv.value)
+// FNV-1a
+func hashKey(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
 	}
+	return h
 }
@@ -0,0 +1,99 @@
+// Created on 2021/4/20 by @zzl
+package lru
+
+import "container/list"
+
+const (
+	segmentLow = iota
+	segmentHigh
+)
+
+// Unpinned entries are kept in two lists, the high priority pool holds
+// entries which are inserted with high priority or hit after their
+// insertion, and is bounded by a share of the capacity.  Entries falling
+// out of it move to the head of the low priority list, where new entries
+// are inserted as well, so entries which are used once never push out
+// entries which are used repeatedly.  Victims are taken from the tail of
+// the low priority list first.
+type lruPolicy struct {
+	highPriPoolRatio float64
+	highCapacity     int64
+	highUsage        int64
+	high             *list.List
+	low              *list.List
+}
+
+func newLRUPolicy(highPriPoolRatio float64) *lruPolicy {
+	return &lruPolicy{
+		highPriPoolRatio: highPriPoolRatio,
+		high:             list.New(),
+		low:              list.New(),
+	}
+}
+
+func (p *lruPolicy) setCapacity(capacity int64) {
+	p.highCapacity = int64(float64(capacity) * p.highPriPoolRatio)
+	p.maintainPoolSize()
+}
+
+// Entries are pinned on insertion, they enter the lists once released.
+func (p *lruPolicy) insert(h *Handle) {}
+
+func (p *lruPolicy) access(h *Handle) {
+	h.referenced = true
+}
+
+func (p *lruPolicy) pin(h *Handle) {
+	p.unlink(h)
+}
+
+func (p *lruPolicy) unpin(h *Handle) {
+	if h.priority == PriorityHigh || h.referenced {
+		h.segment = segmentHigh
+		h.elem = p.high.PushFront(h)
+		p.highUsage += h.charge
+		p.maintainPoolSize()
+	} else {
+		h.segment = segmentLow
+		h.elem = p.low.PushFront(h)
+	}
+}
+
+func (p *lruPolicy) remove(h *Handle) {
+	p.unlink(h)
+}
+
+func (p *lruPolicy) victim() *Handle {
+	if e := p.low.Back(); e != nil {
+		return e.Value.(*Handle)
+	}
+	if e := p.high.Back(); e != nil {
+		return e.Value.(*Handle)
+	}
+	return nil
+}
+
+func (p *lruPolicy) unlink(h *Handle) {
+	if h.elem == nil {
+		return
+	}
+	if h.segment == segmentHigh {
+		p.high.Remove(h.elem)
+		p.highUsage -= h.charge
+	} else {
+		p.low.Remove(h.elem)
+	}
+	h.elem = nil
+}
+
+// Moves the oldest entries of the high priority pool to the low priority
+// list until the pool fits its capacity.
+func (p *lruPolicy) maintainPoolSize() {
+	for p.highUsage > p.highCapacity && p.high.Len() > 0 {
+		h := p.high.Back().Value.(*Handle)
+		p.high.Remove(h.elem)
+		p.highUsage -= h.charge
+		h.segment = segmentLow
+		h.elem = p.low.PushFront(h)
+	}
+}
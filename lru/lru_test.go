@@ -0,0 +1,173 @@
+// Created on 2021/4/18 by @zzl
+package lru
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func Test_CacheCharge(t *testing.T) {
+	var evicted []string
+	c := NewCache(10, 0, func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	})
+	c.Release(c.Insert("a", 1, 4))
+	c.Release(c.Insert("b", 2, 4))
+	if h := c.Lookup("a"); h == nil || h.Value().(int) != 1 {
+		t.Fatal("a should be cached")
+	} else {
+		c.Release(h)
+	}
+	// b is the least recently used entry
+	c.Release(c.Insert("c", 3, 4))
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Fatalf("got evicted %v", evicted)
+	}
+	stats := c.Stats()
+	if stats.Usage != 8 || stats.Evictions != 1 || stats.Hits != 1 || stats.Pinned != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	c.SetCapacity(4)
+	if stats = c.Stats(); stats.Usage != 4 || len(evicted) != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+var policies = []Policy{PolicyLRU, PolicyClock, PolicyTinyLFU}
+
+func Test_CachePinned(t *testing.T) {
+	for _, policy := range policies {
+		testCachePinned(t, policy)
+	}
+}
+
+func testCachePinned(t *testing.T, policy Policy) {
+	var evicted []string
+	c := New(Config{Policy: policy, Capacity: 4}, func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	})
+	a := c.Insert("a", 1, 4)
+	c.Release(c.Insert("b", 2, 4))
+	// a is pinned, b gets evicted instead
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Fatalf("%v: got evicted %v", policy, evicted)
+	}
+
+	// erased but still in use, the callback waits for the release
+	c.Erase("a")
+	if len(evicted) != 1 {
+		t.Fatalf("%v: got evicted %v", policy, evicted)
+	}
+	if c.Lookup("a") != nil {
+		t.Fatalf("%v: a was erased", policy)
+	}
+	if a.Value().(int) != 1 {
+		t.Fatalf("%v: a handle must stay valid", policy)
+	}
+	c.Release(a)
+	if len(evicted) != 2 || evicted[1] != "a" {
+		t.Fatalf("%v: got evicted %v", policy, evicted)
+	}
+	if stats := c.Stats(); stats.Usage != 0 || stats.Pinned != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func Test_CacheConcurrent(t *testing.T) {
+	for _, policy := range policies {
+		testCacheConcurrent(t, policy)
+	}
+}
+
+func testCacheConcurrent(t *testing.T, policy Policy) {
+	var mu sync.Mutex
+	live := make(map[string]int)
+	c := New(Config{Policy: policy, Capacity: 100, NumShardBits: 4}, func(key string, value interface{}) {
+		mu.Lock()
+		live[key]--
+		mu.Unlock()
+	})
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("%d", (g*31+i)%300)
+				if h := c.Lookup(key); h != nil {
+					if h.Key() != key {
+						t.Error("wrong entry")
+					}
+					c.Release(h)
+					continue
+				}
+				mu.Lock()
+				live[key]++
+				mu.Unlock()
+				c.Release(c.Insert(key, i, 1))
+			}
+		}(g)
+	}
+	wg.Wait()
+	c.Purge()
+	for key, n := range live {
+		if n != 0 {
+			t.Fatalf("%v: %s: %d entries not freed", policy, key, n)
+		}
+	}
+}
+
+// A hot set is used repeatedly, then a scan touches every key once.
+func Test_CacheScanResistance(t *testing.T) {
+	hitRatios := make(map[Policy]float64)
+	for _, policy := range policies {
+		c := New(Config{Policy: policy, Capacity: 100, NumShardBits: 0}, nil)
+		get := func(key string) {
+			if h := c.Lookup(key); h != nil {
+				c.Release(h)
+			} else {
+				c.Release(c.Insert(key, nil, 1))
+			}
+		}
+		for round := 0; round < 5; round++ {
+			for i := 0; i < 40; i++ {
+				get(fmt.Sprintf("hot%d", i))
+			}
+		}
+		for i := 0; i < 1000; i++ {
+			get(fmt.Sprintf("scan%d", i))
+		}
+		before := c.Stats()
+		for i := 0; i < 40; i++ {
+			get(fmt.Sprintf("hot%d", i))
+		}
+		stats := c.Stats()
+		hitRatios[policy] = float64(stats.Hits-before.Hits) / 40
+		t.Log(stats)
+	}
+	if hitRatios[PolicyLRU] < 0.9 || hitRatios[PolicyTinyLFU] < 0.9 {
+		t.Fatalf("the hot set should survive the scan: %v", hitRatios)
+	}
+}
+
+func Test_ClockPolicy(t *testing.T) {
+	c := New(Config{Policy: PolicyClock, Capacity: 3, NumShardBits: 0}, nil)
+	for _, key := range []string{"a", "b", "c"} {
+		c.Release(c.Insert(key, nil, 1))
+	}
+	// the reference bit gives a a second chance
+	c.Release(c.Lookup("a"))
+	c.Release(c.Insert("d", nil, 1))
+	if c.Lookup("b") != nil {
+		t.Fatal("b should be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		h := c.Lookup(key)
+		if h == nil {
+			t.Fatalf("%s should be cached", key)
+		}
+		c.Release(h)
+	}
+}
@@ -0,0 +1,221 @@
+// Created on 2021/4/18 by @zzl
+package lru
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Handle references an entry of the cache and keeps it from being freed.
+type Handle struct {
+	key      string
+	value    interface{}
+	charge   int64
+	hash     uint32
+	priority Priority
+	// One reference for the cache while the entry is in it, and one for
+	// every outstanding handle
+	refs    int
+	inCache bool
+
+	// State of the eviction policy
+	elem       *list.Element
+	referenced bool
+	segment    int
+}
+
+// Returns the number of outstanding handles.
+func (h *Handle) handles() int {
+	if h.inCache {
+		return h.refs - 1
+	}
+	return h.refs
+}
+
+func (h *Handle) pinned() bool {
+	return h.handles() > 0
+}
+
+func (h *Handle) Key() string {
+	return h.key
+}
+
+func (h *Handle) Value() interface{} {
+	return h.value
+}
+
+func (h *Handle) Charge() int64 {
+	return h.charge
+}
+
+// A policy orders the entries of a shard for eviction.  Its methods are
+// called with the shard lock held.
+type policy interface {
+	setCapacity(capacity int64)
+	// The entry is added to the cache, pinned by the handle of the caller
+	insert(h *Handle)
+	// The entry is found by a lookup
+	access(h *Handle)
+	// The first handle of the entry is acquired, or the last one released
+	pin(h *Handle)
+	unpin(h *Handle)
+	// The entry leaves the cache
+	remove(h *Handle)
+	// Returns the entry to evict next, which must not be pinned, or nil if
+	// every entry is pinned
+	victim() *Handle
+}
+
+type shard struct {
+	mu       sync.Mutex
+	capacity int64
+	usage    int64
+	pinned   int64
+	table    map[string]*Handle
+	policy   policy
+	stats    Stats
+}
+
+func (s *shard) init(p policy) {
+	s.table = make(map[string]*Handle)
+	s.policy = p
+}
+
+// The following methods return the handles which are freed by the
+// operation, their eviction callbacks run after the lock is released.
+
+func (s *shard) insert(h *Handle) []*Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var freed []*Handle
+	h.refs = 1 // for the returned handle
+	s.pinned += h.charge
+	s.stats.Inserts++
+	if s.capacity > 0 {
+		if old, ok := s.table[h.key]; ok {
+			freed = s.finishErase(old, freed)
+		}
+		h.refs++
+		h.inCache = true
+		s.usage += h.charge
+		s.table[h.key] = h
+		s.policy.insert(h)
+	}
+	// otherwise caching is turned off, the entry only lives as long as
+	// the handle
+	return s.evictToCapacity(freed)
+}
+
+func (s *shard) lookup(key string) *Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.table[key]
+	if !ok {
+		s.stats.Misses++
+		return nil
+	}
+	s.stats.Hits++
+	s.policy.access(h)
+	if !h.pinned() {
+		s.policy.pin(h)
+		s.pinned += h.charge
+	}
+	h.refs++
+	return h
+}
+
+func (s *shard) release(h *Handle) []*Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var freed []*Handle
+	h.refs--
+	if !h.pinned() {
+		s.pinned -= h.charge
+		if h.inCache {
+			// the last handle is released, the entry becomes an
+			// eviction candidate
+			s.policy.unpin(h)
+		}
+	}
+	if h.refs == 0 {
+		freed = append(freed, h)
+	}
+	// the entry may have been kept over the capacity by the handle
+	return s.evictToCapacity(freed)
+}
+
+func (s *shard) erase(key string) []*Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if h, ok := s.table[key]; ok {
+		return s.finishErase(h, nil)
+	}
+	return nil
+}
+
+func (s *shard) prune() []*Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var freed []*Handle
+	for _, h := range s.table {
+		if !h.pinned() {
+			freed = s.finishErase(h, freed)
+		}
+	}
+	return freed
+}
+
+func (s *shard) purge() []*Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var freed []*Handle
+	for _, h := range s.table {
+		freed = s.finishErase(h, freed)
+	}
+	return freed
+}
+
+func (s *shard) setCapacity(capacity int64) []*Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.capacity = capacity
+	s.policy.setCapacity(capacity)
+	return s.evictToCapacity(nil)
+}
+
+// Evicts unpinned entries until the usage fits the capacity, pinned
+// entries may keep the shard over its capacity.
+// REQUIRES: s.mu held
+func (s *shard) evictToCapacity(freed []*Handle) []*Handle {
+	for s.usage > s.capacity {
+		h := s.policy.victim()
+		if h == nil {
+			break
+		}
+		freed = s.finishErase(h, freed)
+		s.stats.Evictions++
+	}
+	return freed
+}
+
+// Removes h from the cache and drops the reference of the cache, the
+// handles may keep it alive.
+// REQUIRES: s.mu held, h is in the cache
+func (s *shard) finishErase(h *Handle, freed []*Handle) []*Handle {
+	delete(s.table, h.key)
+	s.policy.remove(h)
+	s.usage -= h.charge
+	h.refs--
+	h.inCache = false
+	if h.refs == 0 {
+		freed = append(freed, h)
+	}
+	return freed
+}
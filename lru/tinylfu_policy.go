@@ -0,0 +1,219 @@
+// Created on 2021/4/20 by @zzl
+package lru
+
+import "container/list"
+
+const (
+	segmentWindow = iota
+	segmentProbation
+	segmentProtected
+)
+
+// Share of the capacity taken by the admission window, in percent
+const tinyLFUWindowPercent = 1
+
+// Share of the main cache taken by the protected segment, in percent
+const tinyLFUProtectedPercent = 80
+
+// New entries go to a small LRU window.  Entries pushed out of the window
+// become candidates in the probation segment of the main cache, which is
+// a segmented LRU: an entry hit on probation moves to the protected
+// segment, and the protected segment overflows back into probation.  When
+// the cache is full, the latest candidate and the probation victim are
+// compared by their estimated access frequency and the less frequently
+// used one is evicted.
+type tinyLFUPolicy struct {
+	window            *list.List
+	probation         *list.List
+	protected         *list.List
+	windowCapacity    int64
+	protectedCapacity int64
+	usage             [3]int64
+	candidate         *Handle
+	sketch            countMinSketch
+}
+
+func newTinyLFUPolicy() *tinyLFUPolicy {
+	p := &tinyLFUPolicy{
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+	}
+	p.sketch.init()
+	return p
+}
+
+func (p *tinyLFUPolicy) setCapacity(capacity int64) {
+	p.windowCapacity = capacity * tinyLFUWindowPercent / 100
+	if p.windowCapacity < 1 {
+		p.windowCapacity = 1
+	}
+	p.protectedCapacity = (capacity - p.windowCapacity) * tinyLFUProtectedPercent / 100
+	p.maintainProtectedSize()
+}
+
+func (p *tinyLFUPolicy) insert(h *Handle) {
+	p.sketch.increment(h.hash)
+	p.push(h, segmentWindow)
+}
+
+func (p *tinyLFUPolicy) access(h *Handle) {
+	p.sketch.increment(h.hash)
+	switch h.segment {
+	case segmentWindow:
+		p.window.MoveToFront(h.elem)
+	case segmentProbation:
+		p.unlink(h)
+		p.push(h, segmentProtected)
+		p.maintainProtectedSize()
+	case segmentProtected:
+		p.protected.MoveToFront(h.elem)
+	}
+}
+
+// Pinned entries stay in their segment, victims are chosen among the
+// unpinned ones.
+func (p *tinyLFUPolicy) pin(h *Handle) {}
+
+func (p *tinyLFUPolicy) unpin(h *Handle) {}
+
+func (p *tinyLFUPolicy) remove(h *Handle) {
+	p.unlink(h)
+}
+
+func (p *tinyLFUPolicy) victim() *Handle {
+	for p.usage[segmentWindow] > p.windowCapacity && p.window.Len() > 0 {
+		h := p.window.Back().Value.(*Handle)
+		p.unlink(h)
+		p.push(h, segmentProbation)
+		p.candidate = h
+	}
+
+	victim := lastUnpinned(p.probation)
+	if victim == nil {
+		victim = lastUnpinned(p.protected)
+	}
+	if victim == nil {
+		return lastUnpinned(p.window)
+	}
+	candidate := p.candidate
+	if candidate == nil || candidate == victim || candidate.pinned() || victim.segment != segmentProbation {
+		return victim
+	}
+	// admit the candidate only if it is used more often than the entry
+	// it pushes out
+	if p.sketch.frequency(candidate.hash) > p.sketch.frequency(victim.hash) {
+		return victim
+	}
+	return candidate
+}
+
+func (p *tinyLFUPolicy) push(h *Handle, segment int) {
+	h.segment = segment
+	switch segment {
+	case segmentWindow:
+		h.elem = p.window.PushFront(h)
+	case segmentProbation:
+		h.elem = p.probation.PushFront(h)
+	case segmentProtected:
+		h.elem = p.protected.PushFront(h)
+	}
+	p.usage[segment] += h.charge
+}
+
+func (p *tinyLFUPolicy) unlink(h *Handle) {
+	switch h.segment {
+	case segmentWindow:
+		p.window.Remove(h.elem)
+	case segmentProbation:
+		p.probation.Remove(h.elem)
+	case segmentProtected:
+		p.protected.Remove(h.elem)
+	}
+	p.usage[h.segment] -= h.charge
+	h.elem = nil
+	if p.candidate == h {
+		p.candidate = nil
+	}
+}
+
+// Demotes the oldest protected entries to probation until the protected
+// segment fits its capacity.
+func (p *tinyLFUPolicy) maintainProtectedSize() {
+	for p.usage[segmentProtected] > p.protectedCapacity && p.protected.Len() > 0 {
+		h := p.protected.Back().Value.(*Handle)
+		p.unlink(h)
+		p.push(h, segmentProbation)
+	}
+}
+
+func lastUnpinned(l *list.List) *Handle {
+	for e := l.Back(); e != nil; e = e.Prev() {
+		if h := e.Value.(*Handle); !h.pinned() {
+			return h
+		}
+	}
+	return nil
+}
+
+const (
+	sketchDepth    = 4
+	sketchWidth    = 1 << 12
+	maxSketchCount = 15
+	// The counters are halved after this many increments, so that the
+	// estimates follow changes of the workload
+	sketchSampleSize = 10 * sketchWidth
+)
+
+var sketchSeeds = [sketchDepth]uint64{
+	0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325,
+}
+
+// Estimates the access frequency of keys by their hash, with saturating
+// 4-bit counters kept in bytes.
+type countMinSketch struct {
+	counters  [sketchDepth][]uint8
+	additions int
+}
+
+func (s *countMinSketch) init() {
+	for i := range s.counters {
+		s.counters[i] = make([]uint8, sketchWidth)
+	}
+}
+
+func (s *countMinSketch) index(hash uint32, row int) uint64 {
+	// the low bits of the hash select the shard, mix all of them in
+	return ((uint64(hash) + 1) * sketchSeeds[row] >> 32) & (sketchWidth - 1)
+}
+
+func (s *countMinSketch) increment(hash uint32) {
+	for i := range s.counters {
+		if j := s.index(hash, i); s.counters[i][j] < maxSketchCount {
+			s.counters[i][j]++
+		}
+	}
+	s.additions++
+	if s.additions >= sketchSampleSize {
+		s.reset()
+	}
+}
+
+func (s *countMinSketch) frequency(hash uint32) uint8 {
+	min := uint8(maxSketchCount)
+	for i := range s.counters {
+		if c := s.counters[i][s.index(hash, i)]; c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+func (s *countMinSketch) reset() {
+	for i := range s.counters {
+		for j := range s.counters[i] {
+			s.counters[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
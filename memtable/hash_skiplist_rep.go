@@ -0,0 +1,159 @@
+// Created on 2021/4/25 by @zzl
+package memtable
+
+import (
+	"asukadb/arena"
+	"asukadb/skiplist"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Hashes the entries by the first PrefixLength bytes of their user key
+// into BucketCount buckets, each of them a skiplist.  Lookups only search
+// the skiplist of their prefix, which is small if the workload has prefix
+// locality.  Iterating over all entries merges the buckets, which is
+// expensive, so this rep suits memtables that are mostly read by point
+// lookups.
+type HashSkipListRepFactory struct {
+	// A PrefixLength of 0 hashes every key into the same bucket, the rep
+	// is then a single skiplist with a slow iterator
+	PrefixLength int
+	BucketCount  int
+}
+
+const defaultHashBucketCount = 1 << 16
+
+func (factory HashSkipListRepFactory) CreateMemTableRep(arena *arena.Arena, comparator skiplist.Comparator) MemTableRep {
+	bucketCount := factory.BucketCount
+	if bucketCount <= 0 {
+		bucketCount = defaultHashBucketCount
+	}
+	return &hashSkipListRep{
+		arena:        arena,
+		comparator:   comparator,
+		prefixLength: factory.PrefixLength,
+		buckets:      make([]unsafe.Pointer, bucketCount),
+		usage:        int64(bucketCount) * int64(unsafe.Sizeof(unsafe.Pointer(nil))),
+	}
+}
+
+func (HashSkipListRepFactory) Name() string {
+	return "HashSkipListRepFactory"
+}
+
+type hashSkipListRep struct {
+	arena        *arena.Arena
+	comparator   skiplist.Comparator
+	prefixLength int
+	// *skiplist.SkipList, created when the first entry of the bucket is
+	// inserted
+	buckets []unsafe.Pointer
+	// Bytes of the buckets and of the skiplists, accessed atomically
+	usage int64
+}
+
+func (rep *hashSkipListRep) Insert(offset uint64, size int) {
+	bucket := rep.bucketOf(rep.arena.Get(offset, size))
+	list := rep.getBucket(bucket)
+	if list == nil {
+		list = skiplist.New(rep.arena, rep.comparator)
+		if atomic.CompareAndSwapPointer(&rep.buckets[bucket], nil, unsafe.Pointer(list)) {
+			atomic.AddInt64(&rep.usage, int64(unsafe.Sizeof(skiplist.SkipList{})))
+		} else {
+			// created by another writer in the meantime
+			list = rep.getBucket(bucket)
+		}
+	}
+	atomic.AddInt64(&rep.usage, list.InsertConcurrently(offset, size))
+}
+
+func (rep *hashSkipListRep) Seek(target []byte) []byte {
+	list := rep.getBucket(rep.bucketOf(target))
+	if list == nil {
+		return nil
+	}
+	it := list.NewIterator()
+	it.Seek(target)
+	if !it.Valid() {
+		return nil
+	}
+	return it.Key()
+}
+
+// Returns an iterator over a sorted copy of the entries inserted so far.
+func (rep *hashSkipListRep) NewIterator() RepIterator {
+	var keys [][]byte
+	for i := range rep.buckets {
+		if list := rep.getBucket(i); list != nil {
+			it := list.NewIterator()
+			for it.SeekToFirst(); it.Valid(); it.Next() {
+				keys = append(keys, it.Key())
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return rep.comparator(keys[i], keys[j]) < 0
+	})
+	return &keysIterator{keys: keys, comparator: rep.comparator, index: -1}
+}
+
+func (rep *hashSkipListRep) MemoryUsage() int64 {
+	return atomic.LoadInt64(&rep.usage)
+}
+
+func (rep *hashSkipListRep) getBucket(i int) *skiplist.SkipList {
+	return (*skiplist.SkipList)(atomic.LoadPointer(&rep.buckets[i]))
+}
+
+// Returns the bucket of an encoded entry.
+func (rep *hashSkipListRep) bucketOf(entry []byte) int {
+	prefix := entryUserKey(entry)
+	if len(prefix) > rep.prefixLength {
+		prefix = prefix[:rep.prefixLength]
+	}
+	// FNV-1a
+	h := uint32(2166136261)
+	for _, c := range prefix {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return int(h % uint32(len(rep.buckets)))
+}
+
+// Iterates over sorted keys
+type keysIterator struct {
+	keys       [][]byte
+	comparator skiplist.Comparator
+	index      int
+}
+
+func (it *keysIterator) Valid() bool {
+	return it.index >= 0 && it.index < len(it.keys)
+}
+
+func (it *keysIterator) Key() []byte {
+	return it.keys[it.index]
+}
+
+func (it *keysIterator) Next() {
+	it.index++
+}
+
+func (it *keysIterator) Prev() {
+	it.index--
+}
+
+func (it *keysIterator) Seek(target []byte) {
+	it.index = sort.Search(len(it.keys), func(i int) bool {
+		return it.comparator(it.keys[i], target) >= 0
+	})
+}
+
+func (it *keysIterator) SeekToFirst() {
+	it.index = 0
+}
+
+func (it *keysIterator) SeekToLast() {
+	it.index = len(it.keys) - 1
+}
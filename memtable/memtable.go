@@ -2,42 +2,107 @@
 package memtable
 
 import (
+	"asukadb/arena"
 	"asukadb/common"
-	"asukadb/skiplist"
+	"encoding/binary"
+	"sync"
 )
 
+// Entries are stored in the arena encoded like common.InternalKey.EncodeTo,
+// the rep references them by their offset.
 type MemTable struct {
-	table *skiplist.SkipList
-	memoryUsage uint64
+	// Serializes allocations from the arena, inserts and reads don't
+	// take it
+	mu    sync.Mutex
+	cmp   common.Comparator
+	arena *arena.Arena
+	rep   MemTableRep
+	// Charged with the memory of the arena and the rep if not nil
+	manager *WriteBufferManager
+	// Bytes reserved from the manager so far
+	charged  int64
+	released bool
 }
 
-func New() *MemTable {
+// Returns an empty memtable ordered by cmp and indexed by a rep of the
+// factory, a nil cmp means common.BytewiseComparator and a nil factory a
+// skiplist.  manager may be nil.
+func New(cmp common.Comparator, factory MemTableRepFactory, manager *WriteBufferManager) *MemTable {
+	if cmp == nil {
+		cmp = common.BytewiseComparator
+	}
+	if factory == nil {
+		factory = SkipListRepFactory{}
+	}
 	var memTable MemTable
-	memTable.table = skiplist.New(common.InternalKeyComparator)
+	memTable.cmp = cmp
+	memTable.manager = manager
+	memTable.arena = arena.New()
+	memTable.rep = factory.CreateMemTableRep(memTable.arena, memTable.compareEntries)
 	return &memTable
 }
 
 func (memTable *MemTable) NewIterator() *Iterator {
-	return &Iterator{listIter: memTable.table.NewIterator()}
+	return &Iterator{listIter: memTable.rep.NewIterator()}
+}
+
+// Returns the memory of the memtable to its write buffer manager, once
+// the memtable is flushed or dropped.  Nothing may be added afterwards.
+func (memTable *MemTable) Release() {
+	memTable.mu.Lock()
+	defer memTable.mu.Unlock()
+	if memTable.manager != nil && !memTable.released {
+		memTable.manager.FreeMem(memTable.charged)
+	}
+	memTable.released = true
+}
+
+// Returns true if nothing was added to the memtable.
+func (memTable *MemTable) Empty() bool {
+	return memTable.arena.MemoryUsage() == 0
 }
 
 func (memTable *MemTable) Add(seq uint64, valueType common.ValueType, key, value []byte) {
-	internalKey := common.NewInternalKey(seq, valueType, key, value)
+	internalKey := common.InternalKey{Seq: seq, Type: valueType, UserKey: key, UserValue: value}
+	n := internalKey.EncodedLength()
+
+	memTable.mu.Lock()
+	offset, p := memTable.arena.Allocate(n)
+	memTable.mu.Unlock()
+	internalKey.EncodeToBytes(p)
+	memTable.rep.Insert(offset, n)
+	if memTable.manager != nil {
+		memTable.chargeMem()
+	}
+}
 
-	memTable.memoryUsage += uint64(16 + len(key) + len(value))
-	memTable.table.Insert(internalKey)
+// Reserves the memory the arena and the rep have grown by since the last
+// charge.  Concurrent writers may see the growth of each other, only the
+// first of them charges it.
+func (memTable *MemTable) chargeMem() {
+	usage := int64(memTable.ApproximateMemoryUsage())
+	memTable.mu.Lock()
+	grown := usage - memTable.charged
+	if grown > 0 {
+		memTable.charged = usage
+	}
+	memTable.mu.Unlock()
+	if grown > 0 {
+		memTable.manager.ReserveMem(grown)
+	}
 }
 
-func (memTable *MemTable) Get(key []byte) ([]byte, error) {
-	lookupKey := common.LookupKey(key)
-	it := memTable.table.NewIterator()
-	it.Seek(lookupKey)
-	if it.Valid() {
+// Returns the newest value of the key among the entries whose sequence
+// number is at most seq.
+func (memTable *MemTable) Get(key []byte, seq uint64) ([]byte, error) {
+	entry := memTable.rep.Seek(encodeSeekKey(&common.InternalKey{Seq: seq, Type: common.TypeValue, UserKey: key}))
+	if entry != nil {
 		// Check that it belongs to same user key.  We do not check the
 		// sequence number since the Seek() call above should have skipped
 		// all entries with overly large sequence numbers.
-		internalKey := it.Key().(*common.InternalKey)
-		if common.UserKeyComparator(internalKey.UserKey, key) == 0 {
+		var internalKey common.InternalKey
+		internalKey.DecodeFromBytes(entry)
+		if memTable.cmp.Compare(internalKey.UserKey, key) == 0 {
 			// Correct user key
 			if internalKey.Type == common.TypeValue {
 				return internalKey.UserValue, nil
@@ -49,14 +114,44 @@ func (memTable *MemTable) Get(key []byte) ([]byte, error) {
 	return nil, common.ErrNotFound
 }
 
+// Returns the bytes taken by the arena chunks and the rep.
 func (memTable *MemTable) ApproximateMemoryUsage() uint64 {
-	return memTable.memoryUsage
+	return uint64(memTable.arena.MemoryUsage() + memTable.rep.MemoryUsage())
 }
 
-// Iterator
+// Orders encoded entries like common.InternalKeyComparator, without
+// decoding the values.
+func (memTable *MemTable) compareEntries(a, b []byte) int {
+	r := memTable.cmp.Compare(entryUserKey(a), entryUserKey(b))
+	if r == 0 {
+		aNum := binary.LittleEndian.Uint64(a)
+		bNum := binary.LittleEndian.Uint64(b)
+		if aNum > bNum {
+			r = -1
+		} else if aNum < bNum {
+			r = +1
+		}
+	}
+	return r
+}
+
+func entryUserKey(p []byte) []byte {
+	keyLen := binary.LittleEndian.Uint32(p[9:])
+	return p[13 : 13+keyLen]
+}
+
+// Returns the encoding of target suitable for a seek, its value is
+// left out.
+func encodeSeekKey(target *common.InternalKey) []byte {
+	seekKey := common.InternalKey{Seq: target.Seq, Type: target.Type, UserKey: target.UserKey}
+	p := make([]byte, seekKey.EncodedLength())
+	seekKey.EncodeToBytes(p)
+	return p
+}
 
+// Iterator
 type Iterator struct {
-	listIter *skiplist.Iterator
+	listIter RepIterator
 }
 
 // Returns true iff the iterator is positioned at a valid node.
@@ -64,8 +159,11 @@ func (it *Iterator) Valid() bool {
 	return it.listIter.Valid()
 }
 
+// The returned key references the arena, it must not be modified.
 func (it *Iterator) InternalKey() *common.InternalKey {
-	return it.listIter.Key().(*common.InternalKey)
+	var internalKey common.InternalKey
+	internalKey.DecodeFromBytes(it.listIter.Key())
+	return &internalKey
 }
 
 // Advances to the next position.
@@ -81,8 +179,8 @@ func (it *Iterator) Prev() {
 }
 
 // Advance to the first entry with a key >= target
-func (it *Iterator) Seek(target interface{}) {
-	it.listIter.Seek(target)
+func (it *Iterator) Seek(target *common.InternalKey) {
+	it.listIter.Seek(encodeSeekKey(target))
 }
 
 // Position at the first entry in list.
@@ -95,4 +193,4 @@ func (it *Iterator) SeekToFirst() {
 // Final state of iterator is Valid() iff list is not empty.
 func (it *Iterator) SeekToLast() {
 	it.listIter.SeekToLast()
-}
\ No newline at end of file
+}
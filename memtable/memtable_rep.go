@@ -0,0 +1,79 @@
+// Created on 2021/4/25 by @zzl
+package memtable
+
+import (
+	"asukadb/arena"
+	"asukadb/skiplist"
+)
+
+// MemTableRep indexes the entries of a memtable.  The entries live in the
+// arena of the memtable, encoded like common.InternalKey.EncodeTo, and
+// the rep only references them.  All methods are safe for concurrent use.
+type MemTableRep interface {
+	// Adds the entry of size bytes at offset of the arena.
+	// REQUIRES: nothing that compares equal to the entry is in the rep
+	Insert(offset uint64, size int)
+	// Returns the first entry >= target, or nil if there is none.  Reps
+	// partitioned by prefix only look at the entries sharing the prefix
+	// of target, which is enough for point lookups.
+	Seek(target []byte) []byte
+	// Returns an iterator over all entries in order.
+	NewIterator() RepIterator
+	// Returns the number of bytes taken by the rep, the entries are
+	// accounted by the arena.
+	MemoryUsage() int64
+}
+
+type RepIterator interface {
+	Valid() bool
+	Key() []byte
+	Next()
+	Prev()
+	Seek(target []byte)
+	SeekToFirst()
+	SeekToLast()
+}
+
+// Creates the rep of each new memtable.
+type MemTableRepFactory interface {
+	CreateMemTableRep(arena *arena.Arena, comparator skiplist.Comparator) MemTableRep
+	Name() string
+}
+
+// The default rep, a single skiplist over all entries.  Inserts and
+// lookups are O(log n) and never block readers.
+type SkipListRepFactory struct{}
+
+func (SkipListRepFactory) CreateMemTableRep(arena *arena.Arena, comparator skiplist.Comparator) MemTableRep {
+	return &skipListRep{list: skiplist.New(arena, comparator)}
+}
+
+func (SkipListRepFactory) Name() string {
+	return "SkipListRepFactory"
+}
+
+type skipListRep struct {
+	list *skiplist.SkipList
+}
+
+func (rep *skipListRep) Insert(offset uint64, size int) {
+	// writers of the DB don't hold a common lock
+	rep.list.InsertConcurrently(offset, size)
+}
+
+func (rep *skipListRep) Seek(target []byte) []byte {
+	it := rep.list.NewIterator()
+	it.Seek(target)
+	if !it.Valid() {
+		return nil
+	}
+	return it.Key()
+}
+
+func (rep *skipListRep) NewIterator() RepIterator {
+	return rep.list.NewIterator()
+}
+
+func (rep *skipListRep) MemoryUsage() int64 {
+	return rep.list.MemoryUsage()
+}
@@ -2,29 +2,161 @@
 package memtable
 
 import (
+	"asukadb/arena"
 	"asukadb/common"
+	"asukadb/skiplist"
 	"fmt"
 	"math"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
+	"unsafe"
 )
 
 func Test_MemTable(t *testing.T) {
-	memTable := New()
+	memTable := New(nil, nil, nil)
 	memTable.Add(1234567, common.TypeValue, []byte("zzl"), []byte("1209"))
 	for i := 0; i < 10; i++ {
 		go memTable.Add(rand.Uint64(), common.TypeValue, []byte(string(rune(i))), []byte(string(rune(rand.Int()))))
 	}
 	time.Sleep(500 * time.Millisecond)
-	value, _ := memTable.Get([]byte("zzl"))
+	value, _ := memTable.Get([]byte("zzl"), math.MaxUint64)
 	if string(value) != "1209" {
 		t.Fail()
 	}
 	memTable.Add(math.MaxUint64, common.TypeDeletion, []byte(string(rune(3))), nil)
-	value, _ = memTable.Get([]byte(string(rune(3))))
+	value, _ = memTable.Get([]byte(string(rune(3))), math.MaxUint64)
 	if string(value) != "" {
 		t.Fail()
 	}
 	fmt.Println(memTable.ApproximateMemoryUsage())
-}
\ No newline at end of file
+}
+func Test_MemTableMemoryUsage(t *testing.T) {
+	memTable := New(nil, nil, nil)
+	if memTable.ApproximateMemoryUsage() != 0 {
+		t.Fatal("an empty memtable takes no memory")
+	}
+	memTable.Add(1, common.TypeValue, []byte("key"), []byte("value"))
+	usage := memTable.ApproximateMemoryUsage()
+	if usage < arena.ChunkSize || usage > arena.ChunkSize+1024 {
+		t.Fatalf("got %d bytes", usage)
+	}
+	// a large value gets a chunk of its own
+	memTable.Add(2, common.TypeValue, []byte("large"), make([]byte, arena.ChunkSize))
+	if got := memTable.ApproximateMemoryUsage() - usage; got < arena.ChunkSize+13+5+4 {
+		t.Fatalf("got %d more bytes", got)
+	}
+	value, err := memTable.Get([]byte("key"), math.MaxUint64)
+	if err != nil || string(value) != "value" {
+		t.Fatal(err, string(value))
+	}
+	if value, _ = memTable.Get([]byte("large"), math.MaxUint64); len(value) != arena.ChunkSize {
+		t.Fatalf("got %d bytes", len(value))
+	}
+}
+
+func Test_MemTableReps(t *testing.T) {
+	factories := []MemTableRepFactory{
+		SkipListRepFactory{},
+		VectorRepFactory{},
+		HashSkipListRepFactory{PrefixLength: 3, BucketCount: 16},
+	}
+	for _, factory := range factories {
+		memTable := New(nil, factory, nil)
+		if !memTable.Empty() {
+			t.Fatalf("%s: the memtable should be empty", factory.Name())
+		}
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < 1000; i += 4 {
+					key := []byte(fmt.Sprintf("k%02d%04d", i%10, i))
+					memTable.Add(uint64(i+1), common.TypeValue, key, key)
+				}
+			}(w)
+		}
+		wg.Wait()
+		memTable.Add(2000, common.TypeDeletion, []byte("k010001"), nil)
+
+		if value, err := memTable.Get([]byte("k050005"), math.MaxUint64); err != nil || string(value) != "k050005" {
+			t.Fatalf("%s: %v %s", factory.Name(), err, value)
+		}
+		if _, err := memTable.Get([]byte("k010001"), math.MaxUint64); err != common.ErrDeletion {
+			t.Fatalf("%s: got %v", factory.Name(), err)
+		}
+		// older sequence numbers see the value before the deletion
+		if value, err := memTable.Get([]byte("k010001"), 1999); err != nil || string(value) != "k010001" {
+			t.Fatalf("%s: %v %s", factory.Name(), err, value)
+		}
+		if _, err := memTable.Get([]byte("k010001"), 1); err != common.ErrNotFound {
+			t.Fatalf("%s: got %v", factory.Name(), err)
+		}
+		if _, err := memTable.Get([]byte("k990000"), math.MaxUint64); err != common.ErrNotFound {
+			t.Fatalf("%s: got %v", factory.Name(), err)
+		}
+
+		count := 0
+		var prev *common.InternalKey
+		it := memTable.NewIterator()
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if prev != nil && common.NewInternalKeyComparator(nil).Compare(prev, it.InternalKey()) >= 0 {
+				t.Fatalf("%s: entries out of order", factory.Name())
+			}
+			prev = it.InternalKey()
+			count++
+		}
+		if count != 1001 {
+			t.Fatalf("%s: got %d entries", factory.Name(), count)
+		}
+		it.Seek(common.LookupKey([]byte("k010001")))
+		if !it.Valid() || it.InternalKey().Type != common.TypeDeletion {
+			t.Fatalf("%s: the deletion should come first", factory.Name())
+		}
+	}
+}
+
+func Test_HashSkipListRepMemoryUsage(t *testing.T) {
+	memTable := New(nil, HashSkipListRepFactory{PrefixLength: 3, BucketCount: 16}, nil)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("k%02d%04d", i%10, i))
+		memTable.Add(uint64(i+1), common.TypeValue, key, key)
+	}
+	// the running count matches the bytes of the buckets and their lists
+	rep := memTable.rep.(*hashSkipListRep)
+	usage := int64(len(rep.buckets)) * int64(unsafe.Sizeof(unsafe.Pointer(nil)))
+	for i := range rep.buckets {
+		if list := rep.getBucket(i); list != nil {
+			usage += int64(unsafe.Sizeof(skiplist.SkipList{})) + list.MemoryUsage()
+		}
+	}
+	if got := rep.MemoryUsage(); got != usage {
+		t.Fatalf("got %d bytes, want %d", got, usage)
+	}
+}
+
+func Test_MemTableChargesRep(t *testing.T) {
+	factories := []MemTableRepFactory{
+		SkipListRepFactory{},
+		VectorRepFactory{},
+		HashSkipListRepFactory{PrefixLength: 3, BucketCount: 16},
+	}
+	for _, factory := range factories {
+		manager := NewWriteBufferManager(0, nil)
+		memTable := New(nil, factory, manager)
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("k%02d%04d", i%10, i))
+			memTable.Add(uint64(i+1), common.TypeValue, key, key)
+		}
+		// the nodes of the rep are charged along with the arena
+		if got, want := manager.MemoryUsage(), int64(memTable.ApproximateMemoryUsage()); got != want {
+			t.Fatalf("%s: charged %d bytes, want %d", factory.Name(), got, want)
+		}
+		memTable.Release()
+		if got := manager.MemoryUsage(); got != 0 {
+			t.Fatalf("%s: %d bytes left after release", factory.Name(), got)
+		}
+	}
+}
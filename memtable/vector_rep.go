@@ -0,0 +1,121 @@
+// Created on 2021/4/25 by @zzl
+package memtable
+
+import (
+	"asukadb/arena"
+	"asukadb/skiplist"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+// Appends entries to a vector and only sorts it when it is read, which
+// is usually once, when the memtable is flushed.  Suited to bulk loads,
+// lookups in a memtable which keeps being written are expensive as every
+// read after a write sorts the vector again.
+type VectorRepFactory struct{}
+
+func (VectorRepFactory) CreateMemTableRep(arena *arena.Arena, comparator skiplist.Comparator) MemTableRep {
+	return &vectorRep{arena: arena, comparator: comparator}
+}
+
+func (VectorRepFactory) Name() string {
+	return "VectorRepFactory"
+}
+
+type vectorEntry struct {
+	offset uint64
+	size   int
+}
+
+type vectorRep struct {
+	mu         sync.Mutex
+	arena      *arena.Arena
+	comparator skiplist.Comparator
+	entries    []vectorEntry
+	sorted     bool
+}
+
+func (rep *vectorRep) Insert(offset uint64, size int) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.entries = append(rep.entries, vectorEntry{offset, size})
+	rep.sorted = false
+}
+
+func (rep *vectorRep) Seek(target []byte) []byte {
+	it := rep.NewIterator()
+	it.Seek(target)
+	if !it.Valid() {
+		return nil
+	}
+	return it.Key()
+}
+
+// Returns an iterator over the entries inserted so far.
+func (rep *vectorRep) NewIterator() RepIterator {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	if !rep.sorted {
+		// sort a copy, iterators may still read the old vector
+		entries := make([]vectorEntry, len(rep.entries), cap(rep.entries))
+		copy(entries, rep.entries)
+		sort.Slice(entries, func(i, j int) bool {
+			return rep.compare(entries[i], entries[j]) < 0
+		})
+		rep.entries = entries
+		rep.sorted = true
+	}
+	// appends only write past the end of this slice
+	return &vectorIterator{rep: rep, entries: rep.entries[:len(rep.entries):len(rep.entries)], index: -1}
+}
+
+func (rep *vectorRep) MemoryUsage() int64 {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return int64(cap(rep.entries)) * int64(unsafe.Sizeof(vectorEntry{}))
+}
+
+func (rep *vectorRep) key(e vectorEntry) []byte {
+	return rep.arena.Get(e.offset, e.size)
+}
+
+func (rep *vectorRep) compare(a, b vectorEntry) int {
+	return rep.comparator(rep.key(a), rep.key(b))
+}
+
+type vectorIterator struct {
+	rep     *vectorRep
+	entries []vectorEntry
+	index   int
+}
+
+func (it *vectorIterator) Valid() bool {
+	return it.index >= 0 && it.index < len(it.entries)
+}
+
+func (it *vectorIterator) Key() []byte {
+	return it.rep.key(it.entries[it.index])
+}
+
+func (it *vectorIterator) Next() {
+	it.index++
+}
+
+func (it *vectorIterator) Prev() {
+	it.index--
+}
+
+func (it *vectorIterator) Seek(target []byte) {
+	it.index = sort.Search(len(it.entries), func(i int) bool {
+		return it.rep.comparator(it.rep.key(it.entries[i]), target) >= 0
+	})
+}
+
+func (it *vectorIterator) SeekToFirst() {
+	it.index = 0
+}
+
+func (it *vectorIterator) SeekToLast() {
+	it.index = len(it.entries) - 1
+}
@@ -0,0 +1,134 @@
+// Created on 2021/4/27 by @zzl
+package memtable
+
+import (
+	"asukadb/lru"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// Memory of memtables is charged to the cache in entries of this size
+const writeBufferDummyEntrySize = 256 << 10
+
+// A database whose memtables are accounted by a WriteBufferManager.
+type WriteBufferClient interface {
+	// Returns the memory used by the memtable taking new writes.
+	MutableMemTableUsage() int64
+	// Switches to a new memtable and flushes the old one in the
+	// background, unless a flush is already in progress.
+	ScheduleFlush()
+}
+
+// WriteBufferManager bounds the memory of the memtables of all databases
+// sharing it.  Once they use more than the buffer size, the largest
+// mutable memtable is flushed.  If a cache is given, the memory is also
+// charged to it with pinned dummy entries, so that memtables and cached
+// blocks share one budget.  It is safe for concurrent use.
+type WriteBufferManager struct {
+	bufferSize int64
+	memoryUsed int64
+
+	mu      sync.Mutex
+	clients []WriteBufferClient
+	cache   lru.Cache
+	dummies []*lru.Handle
+}
+
+// Returns a manager limiting memtables to bufferSize bytes, cache may be
+// nil.
+func NewWriteBufferManager(bufferSize int64, cache lru.Cache) *WriteBufferManager {
+	return &WriteBufferManager{bufferSize: bufferSize, cache: cache}
+}
+
+func (m *WriteBufferManager) BufferSize() int64 {
+	return m.bufferSize
+}
+
+// Returns the memory used by the memtables of all clients.
+func (m *WriteBufferManager) MemoryUsage() int64 {
+	return atomic.LoadInt64(&m.memoryUsed)
+}
+
+// Returns the memory charged to the cache.
+func (m *WriteBufferManager) CacheCharge() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.dummies)) * writeBufferDummyEntrySize
+}
+
+func (m *WriteBufferManager) Register(client WriteBufferClient) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clients = append(m.clients, client)
+}
+
+func (m *WriteBufferManager) Unregister(client WriteBufferClient) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.clients {
+		if m.clients[i] == client {
+			m.clients = append(m.clients[:i], m.clients[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *WriteBufferManager) ReserveMem(n int64) {
+	used := atomic.AddInt64(&m.memoryUsed, n)
+	if m.cache != nil {
+		m.mu.Lock()
+		for int64(len(m.dummies))*writeBufferDummyEntrySize < used {
+			var key [12]byte
+			copy(key[:], "wbm:")
+			binary.LittleEndian.PutUint64(key[4:], m.cache.NewId())
+			m.dummies = append(m.dummies, m.cache.Insert(string(key[:]), nil, writeBufferDummyEntrySize))
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *WriteBufferManager) FreeMem(n int64) {
+	used := atomic.AddInt64(&m.memoryUsed, -n)
+	if m.cache != nil {
+		m.mu.Lock()
+		// keep a dummy entry of slack so that memory growing and shrinking
+		// around a boundary doesn't churn the cache
+		keep := 0
+		if used > 0 {
+			keep = int((used+writeBufferDummyEntrySize-1)/writeBufferDummyEntrySize) + 1
+		}
+		for len(m.dummies) > keep {
+			h := m.dummies[len(m.dummies)-1]
+			m.dummies = m.dummies[:len(m.dummies)-1]
+			m.cache.Release(h)
+			m.cache.Erase(h.Key())
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Returns true if the memtables use more than the buffer size.
+func (m *WriteBufferManager) ShouldFlush() bool {
+	return m.bufferSize > 0 && m.MemoryUsage() > m.bufferSize
+}
+
+// Asks the client with the largest mutable memtable to flush it.
+// REQUIRES: the caller holds no lock of a client
+func (m *WriteBufferManager) FlushLargest() {
+	m.mu.Lock()
+	clients := append([]WriteBufferClient(nil), m.clients...)
+	m.mu.Unlock()
+
+	var largest WriteBufferClient
+	var largestUsage int64
+	for _, client := range clients {
+		if usage := client.MutableMemTableUsage(); usage > largestUsage {
+			largest = client
+			largestUsage = usage
+		}
+	}
+	if largest != nil {
+		largest.ScheduleFlush()
+	}
+}
@@ -0,0 +1,245 @@
+// Created on 2021/4/6 by @zzl
+package options
+
+import (
+	"asukadb/common"
+	"asukadb/lru"
+	"asukadb/memtable"
+	"asukadb/ratelimit"
+	"math"
+)
+
+// Orders the user keys of a database, see common.Comparator
+type Comparator = common.Comparator
+
+// Options to control the behavior of a database
+type Options struct {
+	// Comparator used to define the order of keys in the table.  A
+	// database must always be opened with the comparator it was created
+	// with, opening it with another one fails.
+	Comparator Comparator
+
+	// Number of open files the database may use.  All but
+	// common.NumNonTableCacheFiles of them are left to the table cache,
+	// tables beyond that are closed once no iterator uses them.
+	MaxOpenFiles int
+
+	// Capacity in bytes of the cache of decoded data blocks, which is
+	// shared by all tables of the database.  Zero disables the cache.
+	// Tables which are memory mapped never use it.
+	BlockCacheCapacity int64
+
+	// If not nil, used as the block cache instead of a cache created from
+	// BlockCacheCapacity and BlockCachePolicy.  Share it between databases,
+	// and with a WriteBufferManager, to bound their memory together.
+	BlockCache lru.Cache
+
+	// Eviction policies of the block cache and the table cache
+	BlockCachePolicy lru.Policy
+	TableCachePolicy lru.Policy
+
+	// Share of the block cache reserved for blocks which were hit after
+	// their insertion, only used by lru.PolicyLRU.  Blocks read once by a
+	// scan can't push them out.
+	BlockCacheHighPriPoolRatio float64
+
+	// If true, table files are memory mapped and blocks are read straight
+	// from the mapping instead of being copied out of the file.
+	UseMmapReads bool
+
+	// Upper bound on the number of bytes mapped at the same time.  Tables
+	// opened once the limit is reached fall back to regular reads.
+	// Zero means no limit.
+	MaxMmapSize int64
+
+	// If true, the index of each table is split into partitions of about
+	// IndexPartitionSize bytes, and only a small top-level index pointing
+	// to the partitions is loaded when the table is opened.
+	PartitionedIndex   bool
+	IndexPartitionSize int
+
+	// If true, each data block gets a hash index mapping user keys to their
+	// entries, so that point lookups skip the binary search.  The number of
+	// buckets is the number of distinct keys divided by the util ratio.
+	DataBlockHashIndex          bool
+	DataBlockHashTableUtilRatio float64
+
+	// Creates the index of each memtable.  memtable.VectorRepFactory
+	// suits bulk loads, memtable.HashSkipListRepFactory point lookups
+	// with prefix locality.
+	MemTableRepFactory memtable.MemTableRepFactory
+
+	// If not nil, bounds the memory of the memtables of all databases
+	// sharing it.
+	WriteBufferManager *memtable.WriteBufferManager
+
+	// How the tables are organized into levels and compacted
+	CompactionStyle CompactionStyle
+	// Only used by CompactionStyleUniversal
+	Universal UniversalCompactionOptions
+
+	// A compaction starts a new output table once the current one overlaps
+	// this many bytes of the level after the output level, so that the
+	// future compaction of any output table stays small.
+	MaxGrandparentOverlapBytes uint64
+
+	// A compaction adds files of its input level which don't make it pick
+	// up more files of the output level, as long as the inputs stay below
+	// this many bytes.
+	ExpandedCompactionByteSizeLimit uint64
+
+	// A compaction is split at the boundaries of its input files into up
+	// to this many subcompactions, which run in parallel.  The outputs are
+	// installed together once all of them are done.
+	MaxSubcompactions int
+
+	// If not nil, called for the entries rewritten by compactions, and by
+	// memtable flushes too if CompactionFilterOnFlush is true.  It may be
+	// called concurrently by subcompactions.
+	CompactionFilter        CompactionFilter
+	CompactionFilterOnFlush bool
+
+	// If not nil, bounds the bytes per second written by flushes and
+	// compactions, and read by compactions too if RateLimitCompactionReads
+	// is true.  Flushes go before compactions.
+	RateLimiter              *ratelimit.RateLimiter
+	RateLimitCompactionReads bool
+}
+
+// Returns the default options.
+func New() *Options {
+	return &Options{
+		Comparator:                      common.BytewiseComparator,
+		MaxOpenFiles:                    common.MaxOpenFiles,
+		BlockCacheCapacity:              8 << 20,
+		BlockCachePolicy:                lru.PolicyLRU,
+		TableCachePolicy:                lru.PolicyLRU,
+		BlockCacheHighPriPoolRatio:      lru.DefaultHighPriPoolRatio,
+		IndexPartitionSize:              4 << 10,
+		DataBlockHashTableUtilRatio:     0.75,
+		MemTableRepFactory:              memtable.SkipListRepFactory{},
+		MaxGrandparentOverlapBytes:      10 * common.MaxFileSize,
+		ExpandedCompactionByteSizeLimit: 25 * common.MaxFileSize,
+		MaxSubcompactions:               1,
+		Universal: UniversalCompactionOptions{
+			SizeRatio:                   1,
+			MinMergeWidth:               2,
+			MaxMergeWidth:               math.MaxInt32,
+			MaxSizeAmplificationPercent: 200,
+			NumRunsCompactionTrigger:    common.L0CompactionTrigger,
+		},
+	}
+}
+
+// How the tables of a database are organized and compacted
+type CompactionStyle int
+
+const (
+	// Tables are kept in levels of growing size limits, a compaction
+	// merges tables of a level into the overlapping ones of the next level.
+	// Reads and space are cheap, but entries are rewritten once per level.
+	CompactionStyleLevel CompactionStyle = iota
+	// Each table of level 0 is a sorted run, the last level holds the
+	// oldest run.  Runs are merged with each other as they pile up, so
+	// entries are rewritten less often, but reads check more runs and
+	// obsolete entries take space for longer.
+	CompactionStyleUniversal
+)
+
+// Options of CompactionStyleUniversal
+type UniversalCompactionOptions struct {
+	// Runs are merged from the newest one while the next older run is at
+	// most this percentage larger than the runs merged so far.
+	SizeRatio int
+
+	// Bounds on the number of runs merged because of their sizes.
+	MinMergeWidth int
+	MaxMergeWidth int
+
+	// Once the runs but the oldest one take more than this percentage of
+	// the size of the oldest one, all runs are merged, which bounds the
+	// space taken by obsolete entries.
+	MaxSizeAmplificationPercent int
+
+	// Runs are only merged once there are this many of them.  If no size
+	// based merge applies, the newest runs are merged to get back under
+	// this number.
+	NumRunsCompactionTrigger int
+}
+
+// Returns common.ErrInvalidOptions if the runs could not be merged as
+// configured.  Writes slow down before the runs reach the trigger, and a
+// merge takes at least two runs.
+func (opts *UniversalCompactionOptions) Validate() error {
+	if opts.NumRunsCompactionTrigger < 2 || opts.NumRunsCompactionTrigger >= common.L0SlowdownWritesTrigger {
+		return common.ErrInvalidOptions
+	}
+	if opts.MinMergeWidth < 2 {
+		return common.ErrInvalidOptions
+	}
+	return nil
+}
+
+// What a CompactionFilter does with an entry
+type CompactionFilterDecision int
+
+const (
+	// The entry is kept unchanged
+	CompactionFilterKeep CompactionFilterDecision = iota
+	// The entry is replaced by a deletion, which hides the older
+	// entries of the key too
+	CompactionFilterRemove
+	// The value of the entry is replaced by the one returned
+	CompactionFilterChangeValue
+)
+
+// Lets the application drop or rewrite entries while they are compacted,
+// e.g. to purge expired data.  Only the newest entry of a key is passed,
+// and only if no live snapshot sees it, so reads of snapshots are never
+// affected.  Deletions are not passed.
+type CompactionFilter interface {
+	// Decides what to do with the entry of key holding value.  level is
+	// the level the entry is compacted from, or -1 if it is flushed from
+	// a memtable, manual is true for compactions run by DB.CompactRange.
+	// The value returned is only used for CompactionFilterChangeValue.
+	// key and value must not be retained after Filter returns.
+	Filter(level int, manual bool, key, value []byte) (CompactionFilterDecision, []byte)
+	// The name of the filter, used in logs
+	Name() string
+}
+
+// Options to control the behavior of DB.IngestExternalFiles
+type IngestExternalFileOptions struct {
+	// If true, the files are moved into the database instead of copied.
+	MoveFiles bool
+}
+
+// A consistent read-only view of a database, see DB.GetSnapshot
+type Snapshot interface {
+	// Returns the sequence number of the last write in the view
+	Sequence() uint64
+}
+
+// Options that control read operations
+type ReadOptions struct {
+	// Should the data read for this iteration be cached in memory?
+	// Callers may wish to set this field to false for bulk scans.
+	FillCache bool
+
+	// If not nil, read as of the supplied snapshot (which must belong
+	// to the DB that is being read and which must not have been
+	// released).  If nil, use an implicit snapshot of the state at the
+	// beginning of this read operation.
+	Snapshot Snapshot
+
+	// If not nil, the blocks read from table files are charged to it at
+	// low priority.  Blocks found in the cache or a mapping are free.
+	RateLimiter *ratelimit.RateLimiter
+}
+
+// Returns the default read options.
+func NewReadOptions() *ReadOptions {
+	return &ReadOptions{
+		FillCache: true,
+	}
+}
@@ -0,0 +1,244 @@
+// Created on 2021/5/5 by @zzl
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Priority of an I/O request, the waiting requests of higher priority
+// are granted first.
+type Priority int
+
+const (
+	// Compactions
+	PriorityLow Priority = iota
+	// Memtable flushes, which hold back writes while they are pending
+	PriorityHigh
+	numPriorities
+)
+
+const (
+	// Tokens are added every refill period, a request is granted at most
+	// the tokens of one period at a time
+	refillPeriod = 100 * time.Millisecond
+	// An auto-tuned limiter adjusts its rate this often
+	tunePeriod = time.Second
+	// The rate of an auto-tuned limiter never drops below its maximum
+	// divided by this
+	autoTuneMinRateDivisor = 20
+)
+
+// A database whose pending compaction work tunes an auto-tuned RateLimiter.
+type Client interface {
+	// Returns the bytes compactions have to rewrite to bring the levels
+	// back under their size limits.
+	PendingCompactionBytes() uint64
+}
+
+// RateLimiter bounds the bytes per second written by flushes and
+// compactions with a token bucket, and optionally the bytes read by
+// compactions.  Share it between databases to bound their I/O together.
+// It is safe for concurrent use.
+type RateLimiter struct {
+	mu             sync.Mutex
+	bytesPerSecond int64
+	// Tokens left in the bucket, refilled every refillPeriod
+	available  int64
+	lastRefill time.Time
+	// Requests waiting for tokens
+	waiting [numPriorities]int
+	// Bytes granted so far
+	totalBytes [numPriorities]int64
+
+	// Auto-tuning, the rate follows the pending compaction bytes of the
+	// clients and reaches maxBytesPerSecond at maxDebt
+	autoTuned         bool
+	maxBytesPerSecond int64
+	maxDebt           uint64
+	lastTune          time.Time
+	clients           []Client
+}
+
+// Returns a limiter granting bytesPerSecond bytes per second, a rate of 0
+// or less means no limit.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	now := time.Now()
+	return &RateLimiter{bytesPerSecond: bytesPerSecond, lastRefill: now, lastTune: now}
+}
+
+// Returns a limiter whose rate grows with the pending compaction bytes of
+// its clients, from a twentieth of maxBytesPerSecond while compactions
+// keep up to maxBytesPerSecond once maxDebt bytes are pending.  A maximum
+// of 0 or less means no limit.
+func NewAutoTunedRateLimiter(maxBytesPerSecond int64, maxDebt uint64) *RateLimiter {
+	limiter := NewRateLimiter(0)
+	limiter.autoTuned = true
+	limiter.maxBytesPerSecond = maxBytesPerSecond
+	limiter.maxDebt = maxDebt
+	limiter.bytesPerSecond = limiter.minRate()
+	return limiter
+}
+
+func (l *RateLimiter) BytesPerSecond() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bytesPerSecond
+}
+
+// Changes the rate, 0 or less means no limit.  An auto-tuned limiter
+// overrides it at its next tuning.
+func (l *RateLimiter) SetBytesPerSecond(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bytesPerSecond = bytesPerSecond
+	if l.available > l.burst() {
+		l.available = l.burst()
+	}
+}
+
+// Returns the bytes granted so far to the requests of priority pri.
+func (l *RateLimiter) TotalBytesThrough(pri Priority) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.totalBytes[pri]
+}
+
+func (l *RateLimiter) Register(client Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clients = append(l.clients, client)
+}
+
+func (l *RateLimiter) Unregister(client Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.clients {
+		if l.clients[i] == client {
+			l.clients = append(l.clients[:i], l.clients[i+1:]...)
+			break
+		}
+	}
+}
+
+// Blocks until n bytes of I/O of priority pri may be done.  Large requests
+// are granted in pieces so that they don't starve the others.
+func (l *RateLimiter) Request(n int64, pri Priority) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for n > 0 {
+		if l.bytesPerSecond <= 0 {
+			l.totalBytes[pri] += n
+			return
+		}
+		var chunk int64
+		l.waiting[pri]++
+		for {
+			l.refill()
+			// The rate may have been lifted or lowered in the meantime, a
+			// chunk larger than the bucket would never be granted
+			chunk = n
+			if burst := l.burst(); chunk > burst {
+				chunk = burst
+			}
+			if l.bytesPerSecond <= 0 || l.available >= chunk && !l.higherWaiting(pri) {
+				break
+			}
+			// Sleep until the bucket holds enough tokens, or for a period
+			// if requests of higher priority go first
+			wait := refillPeriod
+			if l.available < chunk && l.bytesPerSecond > 0 {
+				wait = time.Duration(float64(chunk-l.available) / float64(l.bytesPerSecond) * float64(time.Second))
+				if wait > refillPeriod {
+					wait = refillPeriod
+				}
+			}
+			l.mu.Unlock()
+			time.Sleep(wait)
+			l.mu.Lock()
+		}
+		l.waiting[pri]--
+		if l.bytesPerSecond > 0 {
+			l.available -= chunk
+		}
+		l.totalBytes[pri] += chunk
+		n -= chunk
+	}
+}
+
+// Tokens the bucket holds at most.
+// REQUIRES: l.mu.Lock()
+func (l *RateLimiter) burst() int64 {
+	burst := l.bytesPerSecond / int64(time.Second/refillPeriod)
+	if burst < 1 {
+		burst = 1
+	}
+	return burst
+}
+
+// REQUIRES: l.mu.Lock()
+func (l *RateLimiter) higherWaiting(pri Priority) bool {
+	for p := pri + 1; p < numPriorities; p++ {
+		if l.waiting[p] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the tokens earned since the last refill.
+// REQUIRES: l.mu.Lock()
+func (l *RateLimiter) refill() {
+	now := time.Now()
+	if l.autoTuned && now.Sub(l.lastTune) >= tunePeriod {
+		l.tune()
+		l.lastTune = now
+	}
+	elapsed := now.Sub(l.lastRefill)
+	if elapsed <= 0 || l.bytesPerSecond <= 0 {
+		return
+	}
+	// In floating point, a long idle period times a high rate overflows
+	// an int64, the bucket is full long before anyway
+	tokens := float64(elapsed) / float64(time.Second) * float64(l.bytesPerSecond)
+	if tokens < 1 {
+		return
+	}
+	l.lastRefill = now
+	burst := l.burst()
+	if tokens >= float64(burst-l.available) {
+		l.available = burst
+	} else {
+		l.available += int64(tokens)
+	}
+}
+
+// Sets the rate in proportion to the pending compaction bytes, so that
+// compactions run slowly while they keep up and at full speed once they
+// fall far behind.
+// REQUIRES: l.mu.Lock()
+func (l *RateLimiter) tune() {
+	var debt uint64
+	for _, client := range l.clients {
+		debt += client.PendingCompactionBytes()
+	}
+	minRate := l.minRate()
+	rate := l.maxBytesPerSecond
+	if debt < l.maxDebt {
+		rate = int64(float64(l.maxBytesPerSecond) * float64(debt) / float64(l.maxDebt))
+	}
+	if rate < minRate {
+		rate = minRate
+	}
+	l.bytesPerSecond = rate
+}
+
+// Returns the rate an auto-tuned limiter never drops below.  A small
+// maximum must not round it down to no limit.
+func (l *RateLimiter) minRate() int64 {
+	rate := l.maxBytesPerSecond / autoTuneMinRateDivisor
+	if rate < 1 && l.maxBytesPerSecond > 0 {
+		rate = 1
+	}
+	return rate
+}
@@ -0,0 +1,145 @@
+// Created on 2021/5/5 by @zzl
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Rate(t *testing.T) {
+	l := NewRateLimiter(1 << 20)
+	start := time.Now()
+	// the bucket starts empty
+	l.Request(300<<10, PriorityLow)
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("300KB at 1MB/s took %v", elapsed)
+	}
+	if l.TotalBytesThrough(PriorityLow) != 300<<10 || l.TotalBytesThrough(PriorityHigh) != 0 {
+		t.Fatal("wrong totals")
+	}
+}
+
+func Test_Priority(t *testing.T) {
+	l := NewRateLimiter(1 << 20)
+	var mu sync.Mutex
+	var order []Priority
+	var wg sync.WaitGroup
+	request := func(pri Priority) {
+		defer wg.Done()
+		l.Request(200<<10, pri)
+		mu.Lock()
+		order = append(order, pri)
+		mu.Unlock()
+	}
+	wg.Add(2)
+	go request(PriorityLow)
+	time.Sleep(10 * time.Millisecond)
+	go request(PriorityHigh)
+	wg.Wait()
+	// the flush waited less even though it came later
+	if order[0] != PriorityHigh {
+		t.Fatalf("got order %v", order)
+	}
+}
+
+type debtClient uint64
+
+func (c *debtClient) PendingCompactionBytes() uint64 {
+	return uint64(*c)
+}
+
+func Test_AutoTune(t *testing.T) {
+	l := NewAutoTunedRateLimiter(100<<20, 1<<30)
+	if l.BytesPerSecond() != 5<<20 {
+		t.Fatalf("got %d bytes per second", l.BytesPerSecond())
+	}
+	var c1, c2 debtClient = 256 << 20, 256 << 20
+	l.Register(&c1)
+	l.Register(&c2)
+	l.mu.Lock()
+	l.tune()
+	l.mu.Unlock()
+	if l.BytesPerSecond() != 50<<20 {
+		t.Fatalf("got %d bytes per second with half the max debt", l.BytesPerSecond())
+	}
+
+	c1 = 2 << 30
+	l.mu.Lock()
+	l.tune()
+	l.mu.Unlock()
+	if l.BytesPerSecond() != 100<<20 {
+		t.Fatalf("got %d bytes per second over the max debt", l.BytesPerSecond())
+	}
+
+	l.Unregister(&c1)
+	l.Unregister(&c2)
+	l.mu.Lock()
+	l.tune()
+	l.mu.Unlock()
+	if l.BytesPerSecond() != 5<<20 {
+		t.Fatalf("got %d bytes per second without debt", l.BytesPerSecond())
+	}
+}
+
+func Test_LongIdle(t *testing.T) {
+	l := NewRateLimiter(1 << 30)
+	// a century of tokens overflows an int64, the bucket is simply full
+	l.mu.Lock()
+	l.lastRefill = time.Now().Add(-100 * 365 * 24 * time.Hour)
+	l.mu.Unlock()
+	start := time.Now()
+	l.Request(l.BytesPerSecond()/10, PriorityLow)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("a full bucket took %v", elapsed)
+	}
+	l.mu.Lock()
+	available := l.available
+	l.mu.Unlock()
+	if available != 0 {
+		t.Fatalf("got %d tokens left", available)
+	}
+}
+
+func Test_Unlimited(t *testing.T) {
+	for _, l := range []*RateLimiter{NewRateLimiter(0), NewRateLimiter(-1), NewAutoTunedRateLimiter(0, 1<<30)} {
+		done := make(chan struct{})
+		go func() {
+			l.Request(1<<30, PriorityHigh)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("a limiter without a rate should not block")
+		}
+		if l.TotalBytesThrough(PriorityHigh) != 1<<30 {
+			t.Fatal("wrong total")
+		}
+	}
+
+	// a small maximum keeps a limit
+	if l := NewAutoTunedRateLimiter(10, 1<<30); l.BytesPerSecond() != 1 {
+		t.Fatalf("got %d bytes per second", l.BytesPerSecond())
+	}
+}
+
+func Test_LowerRateWhileWaiting(t *testing.T) {
+	l := NewRateLimiter(10 << 20)
+	done := make(chan struct{})
+	go func() {
+		// waits for a chunk of the size of the bucket at the higher rate
+		l.Request(1<<20, PriorityLow)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.SetBytesPerSecond(1 << 20)
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the request should be granted at the lower rate")
+	}
+	if l.TotalBytesThrough(PriorityLow) != 1<<20 {
+		t.Fatal("wrong total")
+	}
+}
@@ -1,23 +1,46 @@
 // Created on 2021/3/20 by @zzl
 package skiplist
 
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// The key of a node lives in the arena of the list, the node only keeps
+// its offset and size.
 type Node struct {
-	key  interface{}
-	next []*Node
+	offset uint64
+	size   uint32
+	// *Node, accessed atomically once the node is linked into the list
+	next []unsafe.Pointer
 }
 
-func newNode(key interface{}, height int) *Node {
+func newNode(offset uint64, size uint32, height int) *Node {
 	x := new(Node)
-	x.key = key
-	x.next = make([]*Node, height)
+	x.offset = offset
+	x.size = size
+	x.next = make([]unsafe.Pointer, height)
 
 	return x
 }
 
+// Returns the number of bytes taken by a node of the given height.
+func nodeSize(height int) int64 {
+	return int64(unsafe.Sizeof(Node{})) + int64(height)*int64(unsafe.Sizeof(unsafe.Pointer(nil)))
+}
+
+// Load with acquire semantics, so that the fields of the returned node
+// are fully initialized.
 func (node *Node) getNext(level int) *Node {
-	return node.next[level]
+	return (*Node)(atomic.LoadPointer(&node.next[level]))
 }
 
+// Store with release semantics, anybody who reads through this pointer
+// observes a fully initialized version of the inserted node.
 func (node *Node) setNext(level int, x *Node) {
-	node.next[level] = x
-}
\ No newline at end of file
+	atomic.StorePointer(&node.next[level], unsafe.Pointer(x))
+}
+
+func (node *Node) casNext(level int, old, x *Node) bool {
+	return atomic.CompareAndSwapPointer(&node.next[level], unsafe.Pointer(old), unsafe.Pointer(x))
+}
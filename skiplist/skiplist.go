@@ -2,9 +2,10 @@
 package skiplist
 
 import (
-	"asukadb/common"
+	"asukadb/arena"
 	"math/rand"
-	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
 const (
@@ -12,50 +13,147 @@ const (
 	Branching = 4
 )
 
+// Orders the keys of a SkipList
+type Comparator func(a, b []byte) int
+
+// Thread safety
+// -------------
+//
+// Writes require external synchronization, most likely a mutex, unless
+// they go through InsertConcurrently.  Reads require a guarantee that the
+// SkipList will not be destroyed while the read is in progress.  Apart
+// from that, reads progress without any internal locking or
+// synchronization.
+//
+// Invariants:
+//
+// (1) Allocated nodes are never deleted until the SkipList is destroyed.
+//
+// (2) The contents of a Node except for the next pointers are immutable
+// after the Node has been linked into the SkipList.  Only Insert modifies
+// the list, and it is careful to initialize a node and use release stores
+// to publish the node in one or more lists.
 type SkipList struct {
-	maxHeight  int
+	// Height of the entire list, only grows
+	maxHeight  int32
 	head       *Node
-	comparator common.Comparator
-	mu         sync.RWMutex
+	arena      *arena.Arena
+	comparator Comparator
+	// Bytes taken by the nodes, the keys are accounted by the arena
+	nodeBytes int64
 }
 
-func New(comp common.Comparator) *SkipList {
+// Returns an empty list of keys allocated from the arena.
+func New(arena *arena.Arena, comp Comparator) *SkipList {
 	var list SkipList
-	list.head = newNode(nil, MaxHeight)
+	list.head = newNode(0, 0, MaxHeight)
 	list.maxHeight = 1
+	list.arena = arena
 	list.comparator = comp
 	return &list
 }
 
-func (list *SkipList) Insert(key interface{}) {
-	list.mu.Lock()
-	defer list.mu.Unlock()
-
+// Inserts the key of size bytes at offset of the arena.
+// REQUIRES: nothing that compares equal to the key is in the list, and
+// no other goroutine inserts at the same time
+func (list *SkipList) Insert(offset uint64, size int) {
+	key := list.arena.Get(offset, size)
 	_, prev := list.findGreaterOrEqual(key)
 	height := list.randomHeight()
-	if height > list.maxHeight {
-		for i := list.maxHeight; i < height; i++ {
+	if maxHeight := list.getMaxHeight(); height > maxHeight {
+		for i := maxHeight; i < height; i++ {
 			prev[i] = list.head
 		}
-		list.maxHeight = height
+		// It is ok to mutate maxHeight without any synchronization with
+		// concurrent readers.  A concurrent reader that observes the new
+		// value will see either the old value of the new level pointers
+		// from head (nil), or a new value set in the loop below.  In the
+		// former case the reader will immediately drop to the next level
+		// since nil sorts after all keys.  In the latter case the reader
+		// will use the new node.
+		atomic.StoreInt32(&list.maxHeight, int32(height))
 	}
-	x := newNode(key, height)
+	x := newNode(offset, uint32(size), height)
 	for i := 0; i < height; i++ {
 		x.setNext(i, prev[i].getNext(i))
 		prev[i].setNext(i, x)
 	}
+	atomic.AddInt64(&list.nodeBytes, nodeSize(height))
+}
+
+// Like Insert, but safe to call concurrently with other calls of
+// InsertConcurrently.  Each level is linked with a compare-and-swap, a
+// failed one searches the level again from the predecessor found before.
+// Returns the bytes taken by the new node.
+// REQUIRES: nothing that compares equal to the key is in the list
+func (list *SkipList) InsertConcurrently(offset uint64, size int) int64 {
+	key := list.arena.Get(offset, size)
+	height := list.randomHeight()
+	for {
+		maxHeight := list.getMaxHeight()
+		if height <= maxHeight || atomic.CompareAndSwapInt32(&list.maxHeight, int32(maxHeight), int32(height)) {
+			break
+		}
+	}
+
+	var prev, next [MaxHeight]*Node
+	x := list.head
+	for level := list.getMaxHeight() - 1; level >= 0; level-- {
+		prev[level], next[level] = list.findSpliceForLevel(key, x, level)
+		x = prev[level]
+	}
+
+	x = newNode(offset, uint32(size), height)
+	for i := 0; i < height; i++ {
+		for {
+			// x is not reachable at this level yet, but may already be at
+			// the levels below
+			atomic.StorePointer(&x.next[i], unsafe.Pointer(next[i]))
+			if prev[i].casNext(i, next[i], x) {
+				break
+			}
+			// another node was linked in between, its key is still
+			// greater than the one of prev[i]
+			prev[i], next[i] = list.findSpliceForLevel(key, prev[i], i)
+		}
+	}
+	atomic.AddInt64(&list.nodeBytes, nodeSize(height))
+	return nodeSize(height)
 }
 
-func (list *SkipList) Contains(key interface{}) bool {
-	list.mu.RLock()
-	defer list.mu.RUnlock()
+// Returns the nodes of level between which key belongs, the search starts
+// at before, whose key must be less than key.
+func (list *SkipList) findSpliceForLevel(key []byte, before *Node, level int) (*Node, *Node) {
+	for {
+		next := before.getNext(level)
+		if !list.keyIsAfterNode(key, next) {
+			return before, next
+		}
+		before = next
+	}
+}
+
+func (list *SkipList) getMaxHeight() int {
+	return int(atomic.LoadInt32(&list.maxHeight))
+}
+
+func (list *SkipList) Contains(key []byte) bool {
 	x, _ := list.findGreaterOrEqual(key)
-	if x != nil && list.comparator(x.key, key) == 0 {
+	if x != nil && list.comparator(list.key(x), key) == 0 {
 		return true
 	}
 	return false
 }
 
+// Returns the number of bytes taken by the nodes of the list.
+func (list *SkipList) MemoryUsage() int64 {
+	return atomic.LoadInt64(&list.nodeBytes)
+}
+
+func (list *SkipList) key(node *Node) []byte {
+	return list.arena.Get(node.offset, int(node.size))
+}
+
 func (list *SkipList) NewIterator() *Iterator {
 	var it Iterator
 	it.list = list
@@ -70,10 +168,10 @@ func (list *SkipList) randomHeight() int {
 	return height
 }
 
-func (list *SkipList) findGreaterOrEqual(key interface{}) (*Node, [MaxHeight]*Node) {
+func (list *SkipList) findGreaterOrEqual(key []byte) (*Node, [MaxHeight]*Node) {
 	var prev [MaxHeight]*Node
 	x := list.head
-	level := list.maxHeight - 1
+	level := list.getMaxHeight() - 1
 	for true {
 		next := x.getNext(level)
 		if list.keyIsAfterNode(key, next) {
@@ -91,12 +189,12 @@ func (list *SkipList) findGreaterOrEqual(key interface{}) (*Node, [MaxHeight]*No
 	return nil, prev
 }
 
-func (list *SkipList) findLessThan(key interface{}) *Node {
+func (list *SkipList) findLessThan(key []byte) *Node {
 	x := list.head
-	level := list.maxHeight - 1
+	level := list.getMaxHeight() - 1
 	for true {
 		next := x.getNext(level)
-		if next == nil || list.comparator(next.key, key) >= 0 {
+		if next == nil || list.comparator(list.key(next), key) >= 0 {
 			if level == 0 {
 				return x
 			} else {
@@ -110,7 +208,7 @@ func (list *SkipList) findLessThan(key interface{}) *Node {
 }
 func (list *SkipList) findLast() *Node {
 	x := list.head
-	level := list.maxHeight - 1
+	level := list.getMaxHeight() - 1
 	for true {
 		next := x.getNext(level)
 		if next == nil {
@@ -126,8 +224,8 @@ func (list *SkipList) findLast() *Node {
 	return nil
 }
 
-func (list *SkipList) keyIsAfterNode(key interface{}, n *Node) bool {
-	return (n != nil) && (list.comparator(n.key, key) < 0)
+func (list *SkipList) keyIsAfterNode(key []byte, n *Node) bool {
+	return (n != nil) && (list.comparator(list.key(n), key) < 0)
 }
 
 // Iterator
@@ -144,26 +242,20 @@ func (it *Iterator) Valid() bool {
 
 // Returns the key at the current position.
 // REQUIRES: Valid()
-func (it *Iterator) Key() interface{} {
-	return it.node.key
+func (it *Iterator) Key() []byte {
+	return it.list.key(it.node)
 }
 
 // Advances to the next position.
 // REQUIRES: Valid()
 func (it *Iterator) Next() {
-	it.list.mu.RLock()
-	defer it.list.mu.RUnlock()
-
 	it.node = it.node.getNext(0)
 }
 
 // Advances to the previous position.
 // REQUIRES: Valid()
 func (it *Iterator) Prev() {
-	it.list.mu.RLock()
-	defer it.list.mu.RUnlock()
-
-	it.node = it.list.findLessThan(it.node.key)
+	it.node = it.list.findLessThan(it.list.key(it.node))
 	if it.node == it.list.head {
 		it.node = nil
 	}
@@ -171,28 +263,19 @@ func (it *Iterator) Prev() {
 
 // Advance to the first entry with a key >= target
 // REQUIRES: Valid()
-func (it *Iterator) Seek(target interface{}) {
-	it.list.mu.RLock()
-	defer it.list.mu.RUnlock()
-
+func (it *Iterator) Seek(target []byte) {
 	it.node, _ = it.list.findGreaterOrEqual(target)
 }
 
 // Position at the first entry in list.
 // Final state of iterator is Valid() iff list is not empty.
 func (it *Iterator) SeekToFirst() {
-	it.list.mu.RLock()
-	defer it.list.mu.RUnlock()
-
 	it.node = it.list.head.getNext(0)
 }
 
 // Position at the last entry in list.
 // Final state of iterator is Valid() iff list is not empty.
 func (it *Iterator) SeekToLast() {
-	it.list.mu.RLock()
-	defer it.list.mu.RUnlock()
-
 	it.node = it.list.findLast()
 	if it.node == it.list.head {
 		it.node = nil
@@ -2,30 +2,153 @@
 package skiplist
 
 import (
-	"asukadb/common"
+	"asukadb/arena"
+	"bytes"
+	"encoding/binary"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
-	"time"
 )
 
 func Test_Insert(t *testing.T) {
-	list := New(common.IntComparator)
-	ans := make([]int, 10)
-	for i := 0; i < 10; i++ {
-		num := rand.Int() % 10
-		ans[i] = num
-		go list.Insert(num)
-	}
-	time.Sleep(500 * time.Millisecond)
+	a := arena.New()
+	list := New(a, bytes.Compare)
+	for _, num := range rand.Perm(1000) {
+		offset, p := a.Allocate(4)
+		binary.BigEndian.PutUint32(p, uint32(num))
+		list.Insert(offset, 4)
+	}
 	it := list.NewIterator()
 	index := 0
-	prev := -1
 	for it.SeekToFirst(); it.Valid(); it.Next() {
-		if common.IntComparator(it.Key(), prev) < 0 {
-			t.Fail()
-			prev = it.Key().(int)
+		if binary.BigEndian.Uint32(it.Key()) != uint32(index) {
+			t.Fatalf("got %d at %d", binary.BigEndian.Uint32(it.Key()), index)
 		}
 		index++
 	}
+	if index != 1000 {
+		t.Fatalf("got %d keys", index)
+	}
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		index--
+		if binary.BigEndian.Uint32(it.Key()) != uint32(index) {
+			t.Fatalf("got %d at %d", binary.BigEndian.Uint32(it.Key()), index)
+		}
+	}
+	if !list.Contains([]byte{0, 0, 1, 0}) || list.Contains([]byte{0, 0, 4, 0}) {
+		t.Fatal("wrong membership")
+	}
+	if list.MemoryUsage() < 1000*nodeSize(1) {
+		t.Fatal("nodes must be accounted")
+	}
 }
 
+// A single writer inserts while readers scan and seek without locks.
+// Every key inserted before a reader starts must be visible to it, and
+// every scan must be sorted.
+func Test_ConcurrentReaders(t *testing.T) {
+	const numKeys = 20000
+	a := arena.New()
+	list := New(a, bytes.Compare)
+	var inserted int64 // keys [0, inserted) of the permutation are in the list
+	perm := rand.Perm(numKeys)
+	var done int32
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&done) == 0 {
+				n := atomic.LoadInt64(&inserted)
+				count := int64(0)
+				var prev []byte
+				it := list.NewIterator()
+				for it.SeekToFirst(); it.Valid(); it.Next() {
+					if prev != nil && bytes.Compare(prev, it.Key()) >= 0 {
+						t.Error("keys out of order")
+						return
+					}
+					prev = it.Key()
+					count++
+				}
+				if count < n {
+					t.Errorf("saw %d keys, %d were inserted", count, n)
+					return
+				}
+				if n > 0 {
+					var target [4]byte
+					binary.BigEndian.PutUint32(target[:], uint32(perm[rand.Int63n(n)]))
+					it.Seek(target[:])
+					if !it.Valid() || !bytes.Equal(it.Key(), target[:]) {
+						t.Error("an inserted key is missing")
+						return
+					}
+				}
+			}
+		}()
+	}
+	for _, num := range perm {
+		offset, p := a.Allocate(4)
+		binary.BigEndian.PutUint32(p, uint32(num))
+		list.Insert(offset, 4)
+		atomic.AddInt64(&inserted, 1)
+	}
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+}
+
+// Writers insert through compare-and-swap, none of their keys may get lost.
+func Test_InsertConcurrently(t *testing.T) {
+	const numWriters = 8
+	const keysPerWriter = 5000
+	a := arena.New()
+	list := New(a, bytes.Compare)
+	var arenaMu sync.Mutex
+
+	var wg sync.WaitGroup
+	for w := 0; w < numWriters; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for _, i := range rand.Perm(keysPerWriter) {
+				// keys of the writers interleave
+				arenaMu.Lock()
+				offset, p := a.Allocate(4)
+				arenaMu.Unlock()
+				binary.BigEndian.PutUint32(p, uint32(i*numWriters+w))
+				list.InsertConcurrently(offset, 4)
+			}
+		}(w)
+	}
+	// readers never block the writers
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			var prev []byte
+			it := list.NewIterator()
+			for it.SeekToFirst(); it.Valid(); it.Next() {
+				if prev != nil && bytes.Compare(prev, it.Key()) >= 0 {
+					t.Error("keys out of order")
+					return
+				}
+				prev = it.Key()
+			}
+		}
+	}()
+	wg.Wait()
+
+	it := list.NewIterator()
+	index := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if binary.BigEndian.Uint32(it.Key()) != uint32(index) {
+			t.Fatalf("got %d at %d", binary.BigEndian.Uint32(it.Key()), index)
+		}
+		index++
+	}
+	if index != numWriters*keysPerWriter {
+		t.Fatalf("got %d keys", index)
+	}
+}
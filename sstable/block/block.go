@@ -3,39 +3,76 @@ package block
 
 import (
 	"asukadb/common"
-	"bytes"
 	"encoding/binary"
+	"unsafe"
 )
 
 type Block struct {
 	items []common.InternalKey
+	// Encoded buckets of the hash index, nil if the block has none
+	buckets []byte
+	// Size of the encoded block the items reference
+	size int
 }
 
+// The keys and values of the returned block reference p directly,
+// so p must not be modified or released while the block is in use.
 func New(p []byte) *Block {
+	if len(p) < 4 {
+		return nil
+	}
 	var block Block
-	data := bytes.NewBuffer(p)
+	block.size = len(p)
 	counter := binary.LittleEndian.Uint32(p[len(p)-4:])
+	data := p[:len(p)-4]
+	if counter&hashIndexFlag != 0 {
+		counter &^= hashIndexFlag
+		if len(data) < 2 {
+			return nil
+		}
+		numBuckets := int(binary.LittleEndian.Uint16(data[len(data)-2:]))
+		data = data[:len(data)-2]
+		if numBuckets == 0 || len(data) < 2*numBuckets {
+			return nil
+		}
+		block.buckets = data[len(data)-2*numBuckets:]
+		data = data[:len(data)-2*numBuckets]
+	}
 
+	block.items = make([]common.InternalKey, counter)
 	for i := uint32(0); i < counter; i++ {
-		var item common.InternalKey
-		err := item.DecodeFrom(data)
-		if err != nil {
+		n := block.items[i].DecodeFromBytes(data)
+		if n == 0 {
 			return nil
 		}
-		block.items = append(block.items, item)
+		data = data[n:]
 	}
 
 	return &block
 }
 
-func (block *Block) NewIterator() *Iterator {
-	return &Iterator{block: block}
+// Returns the bytes held by the block, including the decoded entries.
+func (block *Block) ApproximateMemoryUsage() int {
+	return block.size + len(block.items)*int(unsafe.Sizeof(common.InternalKey{}))
+}
+
+// Overrides the sequence number of every entry in the block.
+func (block *Block) SetSeq(seq uint64) {
+	for i := range block.items {
+		block.items[i].Seq = seq
+	}
+}
+
+// Returns an iterator over the block, whose user keys are ordered by cmp.
+func (block *Block) NewIterator(cmp common.Comparator) *Iterator {
+	return &Iterator{block: block, cmp: cmp}
 }
 
 // Iterator
 
 type Iterator struct {
 	block *Block
+	cmp   common.Comparator
 	index int
 }
 
@@ -67,14 +104,14 @@ func (it *Iterator) Seek(target interface{}) {
 	right := len(it.block.items) - 1
 	for left < right {
 		mid := (left + right) / 2
-		if common.UserKeyComparator(it.block.items[mid].UserKey, target) < 0 {
+		if it.cmp.Compare(it.block.items[mid].UserKey, target.([]byte)) < 0 {
 			left = mid + 1
 		} else {
 			right = mid
 		}
 	}
 	if left == len(it.block.items)-1 {
-		if common.UserKeyComparator(it.block.items[left].UserKey, target) < 0 {
+		if it.cmp.Compare(it.block.items[left].UserKey, target.([]byte)) < 0 {
 			// not found
 			left++
 		}
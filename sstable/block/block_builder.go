@@ -10,20 +10,44 @@ import (
 type BlockBuilder struct {
 	buf     bytes.Buffer
 	counter uint32
+	// Build a hash index for point lookups if utilRatio > 0
+	utilRatio float64
+	hashIndex hashIndexBuilder
+	lastKey   []byte
+}
+
+// Makes the builder append a hash index to the blocks it builds, with
+// about one bucket per utilRatio distinct user keys.
+func (blockBuilder *BlockBuilder) EnableHashIndex(utilRatio float64) {
+	blockBuilder.utilRatio = utilRatio
 }
 
 func (blockBuilder *BlockBuilder) Reset() {
 	blockBuilder.counter = 0
 	blockBuilder.buf.Reset()
+	blockBuilder.hashIndex.reset()
+	blockBuilder.lastKey = blockBuilder.lastKey[:0]
 }
 
 func (blockBuilder *BlockBuilder) Add(item *common.InternalKey) error {
+	if blockBuilder.utilRatio > 0 {
+		// only the newest entry of each user key goes to the hash index
+		if blockBuilder.counter == 0 || !bytes.Equal(item.UserKey, blockBuilder.lastKey) {
+			blockBuilder.hashIndex.add(item.UserKey, blockBuilder.counter)
+			blockBuilder.lastKey = append(blockBuilder.lastKey[:0], item.UserKey...)
+		}
+	}
 	blockBuilder.counter++
 	return item.EncodeTo(&blockBuilder.buf)
 }
 
 func (blockBuilder *BlockBuilder) Finish() []byte {
-	binary.Write(&blockBuilder.buf, binary.LittleEndian, blockBuilder.counter)
+	counter := blockBuilder.counter
+	if blockBuilder.utilRatio > 0 && counter > 0 && counter <= maxHashIndexEntries {
+		blockBuilder.buf.Write(blockBuilder.hashIndex.finish(blockBuilder.utilRatio))
+		counter |= hashIndexFlag
+	}
+	binary.Write(&blockBuilder.buf, binary.LittleEndian, counter)
 	return blockBuilder.buf.Bytes()
 }
 
@@ -3,6 +3,7 @@ package block
 
 import (
 	"asukadb/common"
+	"fmt"
 	"testing"
 )
 
@@ -18,11 +19,11 @@ func Test_Block(t *testing.T) {
 	p := builder.Finish()
 
 	block := New(p)
-	it := block.NewIterator()
+	it := block.NewIterator(common.BytewiseComparator)
 
 	it.Seek([]byte("aaa"))
 	if it.Valid() {
-		if string(it.InternalKey().UserKey) != "123" {
+		if string(it.InternalKey().UserValue) != "123" {
 			t.Fail()
 		}
 
@@ -30,3 +31,48 @@ func Test_Block(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_BlockHashIndex(t *testing.T) {
+	var builder BlockBuilder
+	builder.EnableHashIndex(0.75)
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		// two versions of each key, the newest comes first
+		builder.Add(common.NewInternalKey(uint64(2*i+1), common.TypeValue, key, []byte("new")))
+		builder.Add(common.NewInternalKey(uint64(2*i), common.TypeValue, key, []byte("old")))
+	}
+	block := New(builder.Finish())
+	if block == nil || block.buckets == nil {
+		t.Fatal("block should have a hash index")
+	}
+	it := block.NewIterator(common.BytewiseComparator)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if !it.SeekForGet(key) || !it.Valid() {
+			t.Fatalf("key %s not found", key)
+		}
+		item := it.InternalKey()
+		if string(item.UserKey) != string(key) || string(item.UserValue) != "new" {
+			t.Fatalf("key %s: got %s=%s", key, item.UserKey, item.UserValue)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("absent%03d", i))
+		if it.SeekForGet(key) && it.Valid() && string(it.InternalKey().UserKey) == string(key) {
+			t.Fatalf("key %s should not be found", key)
+		}
+	}
+
+	// blocks without a hash index are still readable
+	var plain BlockBuilder
+	plain.Add(common.NewInternalKey(1, common.TypeValue, []byte("aaa"), []byte("123")))
+	block = New(plain.Finish())
+	if block == nil || block.buckets != nil {
+		t.Fatal("block should not have a hash index")
+	}
+	it = block.NewIterator(common.BytewiseComparator)
+	if !it.SeekForGet([]byte("aaa")) || !it.Valid() {
+		t.Fatal("key aaa not found")
+	}
+}
@@ -0,0 +1,112 @@
+// Created on 2021/4/14 by @zzl
+package block
+
+import (
+	"encoding/binary"
+)
+
+// A data block may end with a hash index, mapping the hash of each user key
+// to the first entry of that key in the block.  The layout is:
+//
+//    entries | bucket_0 ... bucket_n-1 (uint16) | n (uint16) | counter (uint32)
+//
+// and the highest bit of counter tells whether the hash index is present.
+
+const (
+	hashIndexFlag = 1 << 31
+	// Bucket values which do not point to an entry
+	hashNoEntry   = 0xffff
+	hashCollision = 0xfffe
+	// Entries beyond this cannot be referenced from a bucket
+	maxHashIndexEntries = hashCollision
+)
+
+type hashIndexBuilder struct {
+	hashes  []uint32
+	entries []uint16
+}
+
+// Records that entry is the first one of the user key in the block.
+func (builder *hashIndexBuilder) add(userKey []byte, entry uint32) {
+	builder.hashes = append(builder.hashes, hashKey(userKey))
+	builder.entries = append(builder.entries, uint16(entry))
+}
+
+func (builder *hashIndexBuilder) reset() {
+	builder.hashes = builder.hashes[:0]
+	builder.entries = builder.entries[:0]
+}
+
+// Returns the encoded buckets followed by their number.
+func (builder *hashIndexBuilder) finish(utilRatio float64) []byte {
+	numBuckets := int(float64(len(builder.hashes)) / utilRatio)
+	if numBuckets < 1 {
+		numBuckets = 1
+	}
+	if numBuckets > 0xffff {
+		numBuckets = 0xffff
+	}
+	buckets := make([]uint16, numBuckets)
+	for i := range buckets {
+		buckets[i] = hashNoEntry
+	}
+	for i, h := range builder.hashes {
+		bucket := h % uint32(numBuckets)
+		if buckets[bucket] == hashNoEntry {
+			buckets[bucket] = builder.entries[i]
+		} else {
+			buckets[bucket] = hashCollision
+		}
+	}
+	p := make([]byte, 2*numBuckets+2)
+	for i, entry := range buckets {
+		binary.LittleEndian.PutUint16(p[2*i:], entry)
+	}
+	binary.LittleEndian.PutUint16(p[2*numBuckets:], uint16(numBuckets))
+	return p
+}
+
+// Returns the entry the bucket of userKey points to, hashNoEntry or
+// hashCollision.
+func (block *Block) lookupHashIndex(userKey []byte) uint16 {
+	numBuckets := uint32(len(block.buckets) / 2)
+	bucket := hashKey(userKey) % numBuckets
+	return binary.LittleEndian.Uint16(block.buckets[2*bucket:])
+}
+
+// Like Seek, but goes straight to the entry through the hash index when the
+// block has one.  Returns false if target is known not to be in the block,
+// the iterator is then left invalid.
+func (it *Iterator) SeekForGet(target []byte) bool {
+	if it.block.buckets == nil {
+		it.Seek(target)
+		return true
+	}
+	entry := it.block.lookupHashIndex(target)
+	switch entry {
+	case hashNoEntry:
+		it.index = len(it.block.items)
+		return false
+	case hashCollision:
+		// fall back to binary search
+		it.Seek(target)
+		return true
+	}
+	if int(entry) >= len(it.block.items) || it.cmp.Compare(it.block.items[entry].UserKey, target) != 0 {
+		// the bucket belongs to another key
+		it.index = len(it.block.items)
+		return false
+	}
+	it.index = int(entry)
+	return true
+}
+
+// FNV-1a
+func hashKey(key []byte) uint32 {
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return h
+}
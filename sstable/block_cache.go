@@ -0,0 +1,81 @@
+// Created on 2021/4/16 by @zzl
+package sstable
+
+import (
+	"asukadb/lru"
+	"asukadb/options"
+	"asukadb/sstable/block"
+	"encoding/binary"
+)
+
+// Shards of the block cache hold at least this many bytes, small caches
+// use fewer shards so that a single large block can't flush a shard.
+const minBlockCacheShardSize = 512 << 10
+
+const maxBlockCacheShardBits = 6
+
+// Counters of a BlockCache
+type BlockCacheStats = lru.Stats
+
+// BlockCache keeps decoded data blocks of all tables of a database, charged
+// by their size.  It is safe for concurrent use.
+type BlockCache struct {
+	cache lru.Cache
+}
+
+// Returns a block cache with the capacity, eviction policy and high
+// priority pool ratio of opts, or a block cache on top of opts.BlockCache
+// if it is set.
+func NewBlockCache(opts *options.Options) *BlockCache {
+	if opts.BlockCache != nil {
+		return &BlockCache{cache: opts.BlockCache}
+	}
+	capacity := opts.BlockCacheCapacity
+	numShardBits := 0
+	for numShardBits < maxBlockCacheShardBits && capacity>>uint(numShardBits+1) >= minBlockCacheShardSize {
+		numShardBits++
+	}
+	return &BlockCache{cache: lru.New(lru.Config{
+		Policy:           opts.BlockCachePolicy,
+		Capacity:         capacity,
+		NumShardBits:     numShardBits,
+		HighPriPoolRatio: opts.BlockCacheHighPriPoolRatio,
+	}, nil)}
+}
+
+// Returns a new id, each table takes one to partition the key space of
+// the cache.
+func (c *BlockCache) NewId() uint64 {
+	return c.cache.NewId()
+}
+
+// Blocks are identified by the cache id of their table and their offset
+func blockCacheKey(id, offset uint64) string {
+	var p [16]byte
+	binary.LittleEndian.PutUint64(p[:], id)
+	binary.LittleEndian.PutUint64(p[8:], offset)
+	return string(p[:])
+}
+
+// Blocks are not pinned while they are used, an evicted block stays valid
+// as long as an iterator references it.
+func (c *BlockCache) lookup(id, offset uint64) *block.Block {
+	h := c.cache.Lookup(blockCacheKey(id, offset))
+	if h == nil {
+		return nil
+	}
+	defer c.cache.Release(h)
+	return h.Value().(*block.Block)
+}
+
+func (c *BlockCache) insert(id, offset uint64, b *block.Block) {
+	c.cache.Release(c.cache.Insert(blockCacheKey(id, offset), b, int64(b.ApproximateMemoryUsage())))
+}
+
+func (c *BlockCache) SetCapacity(capacity int64) {
+	c.cache.SetCapacity(capacity)
+}
+
+func (c *BlockCache) Stats() BlockCacheStats {
+	return c.cache.Stats()
+}
@@ -7,26 +7,82 @@ import (
 	"io"
 )
 
-const MagicNumber uint64 = 0x0000141e36d08385
+// Format versions of a table, the reader dispatches on the version
+// recorded in the footer so that older tables stay readable.
+const (
+	// Fixed 32-bit block handles, no meta index block
+	LegacyFormatVersion = 0
+	// Varint 64-bit block handles, properties in the meta index block
+	FormatVersion1 = 1
+	// Same blocks as version 1, but the footer records the version
+	FormatVersion2 = 2
+
+	CurrentFormatVersion = FormatVersion2
+)
+
+// The magic number tells the layout of the footer:
+//
+//    legacy:    metaindex (fixed32 x2) | index (fixed32 x2) | LegacyMagicNumber
+//    version 1: metaindex | index | padding | MagicNumber
+//    versioned: metaindex | index | padding | version (fixed32) | VersionedMagicNumber
+//
+// where the handles of the later two are varint encoded and padded to
+// 2*MaxEncodedLength bytes.
+const (
+	LegacyMagicNumber    uint64 = 0x0000141e36d08385
+	MagicNumber          uint64 = 0x6173756b61646232
+	VersionedMagicNumber uint64 = 0x6173756b61646233
+)
 
+// Maximum encoding length of a BlockHandle
+const MaxEncodedLength = 2 * binary.MaxVarintLen64
+
+// Encoded lengths of the footer layouts.  Note that the serialization
+// of a footer always occupies exactly this many bytes.
+const (
+	LegacyFooterEncodedLength    = 8 + 8 + 8
+	FooterEncodedLength          = 2*MaxEncodedLength + 8
+	VersionedFooterEncodedLength = 2*MaxEncodedLength + 4 + 8
+)
 
 type BlockHandle struct {
-	Offset uint32
-	Size   uint32
+	Offset uint64
+	Size   uint64
 }
 
 func (blockHandle *BlockHandle) EncodeToBytes() []byte {
-	p := make([]byte, 8)
-	binary.LittleEndian.PutUint32(p, blockHandle.Offset)
-	binary.LittleEndian.PutUint32(p[4:], blockHandle.Size)
-	return p
+	p := make([]byte, MaxEncodedLength)
+	n := binary.PutUvarint(p, blockHandle.Offset)
+	n += binary.PutUvarint(p[n:], blockHandle.Size)
+	return p[:n]
 }
 
-func (blockHandle *BlockHandle) DecodeFromBytes(p []byte) {
-	if len(p) == 8 {
-		blockHandle.Offset = binary.LittleEndian.Uint32(p)
-		blockHandle.Size = binary.LittleEndian.Uint32(p[4:])
+// Returns the number of bytes consumed, or 0 if p is not a valid handle.
+func (blockHandle *BlockHandle) DecodeFromBytes(p []byte) int {
+	offset, n := binary.Uvarint(p)
+	if n <= 0 {
+		return 0
 	}
+	size, m := binary.Uvarint(p[n:])
+	if m <= 0 {
+		return 0
+	}
+	blockHandle.Offset = offset
+	blockHandle.Size = size
+	return n + m
+}
+
+// Decodes a handle of the given table format version.
+func (blockHandle *BlockHandle) DecodeFromBytesWithVersion(p []byte, formatVersion uint32) int {
+	if formatVersion != LegacyFormatVersion {
+		return blockHandle.DecodeFromBytes(p)
+	}
+	if len(p) < 8 {
+		return 0
+	}
+	blockHandle.Offset = uint64(binary.LittleEndian.Uint32(p))
+	blockHandle.Size = uint64(binary.LittleEndian.Uint32(p[4:]))
+	return 8
 }
 
 type IndexBlockHandle struct {
@@ -37,8 +93,8 @@ func (index *IndexBlockHandle) SetBlockHandle(blockHandle BlockHandle) {
 	index.UserValue = blockHandle.EncodeToBytes()
 }
 
-func (index *IndexBlockHandle) GetBlockHandle() (blockHandle BlockHandle) {
-	blockHandle.DecodeFromBytes(index.UserValue)
+func (index *IndexBlockHandle) GetBlockHandle(formatVersion uint32) (blockHandle BlockHandle) {
+	blockHandle.DecodeFromBytesWithVersion(index.UserValue, formatVersion)
 	return
 }
 
@@ -58,34 +114,63 @@ func (index *MetaIndexBlockHandle) GetBlockHandle() (blockHandle BlockHandle) {
 type Footer struct {
 	MetaIndexHandle BlockHandle
 	IndexHandle     BlockHandle
+	Version         uint32
 }
 
 func (footer *Footer) Size() int {
-	// add magic size
-	return binary.Size(footer) + 8
+	switch footer.Version {
+	case LegacyFormatVersion:
+		return LegacyFooterEncodedLength
+	case FormatVersion1:
+		return FooterEncodedLength
+	default:
+		return VersionedFooterEncodedLength
+	}
 }
 
+// Always writes the versioned layout.
 func (footer *Footer) EncodeTo(w io.Writer) error {
-	err := binary.Write(w, binary.LittleEndian, footer)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, MagicNumber)
+	p := make([]byte, VersionedFooterEncodedLength)
+	n := copy(p, footer.MetaIndexHandle.EncodeToBytes())
+	copy(p[n:], footer.IndexHandle.EncodeToBytes())
+	// the rest of the handle area is left as zero padding
+	binary.LittleEndian.PutUint32(p[2*MaxEncodedLength:], footer.Version)
+	binary.LittleEndian.PutUint64(p[2*MaxEncodedLength+4:], VersionedMagicNumber)
+	_, err := w.Write(p)
 	return err
 }
 
-func (footer *Footer) DecodeFrom(r io.Reader) error {
-	err := binary.Read(r, binary.LittleEndian, footer)
-	if err != nil {
-		return err
+// Decodes the footer from the tail of a table, p must hold the last
+// VersionedFooterEncodedLength bytes of the file, or the whole file if
+// it is shorter.
+func (footer *Footer) DecodeFrom(p []byte) error {
+	if len(p) < 8 {
+		return common.ErrTableFileTooShort
 	}
-	var magic uint64
-	err = binary.Read(r, binary.LittleEndian, &magic)
-	if err != nil {
-		return err
-	}
-	if magic != MagicNumber {
+	magic := binary.LittleEndian.Uint64(p[len(p)-8:])
+	switch magic {
+	case LegacyMagicNumber:
+		footer.Version = LegacyFormatVersion
+	case MagicNumber:
+		footer.Version = FormatVersion1
+	case VersionedMagicNumber:
+		if len(p) < VersionedFooterEncodedLength {
+			return common.ErrTableFileTooShort
+		}
+		footer.Version = binary.LittleEndian.Uint32(p[len(p)-12:])
+		if footer.Version < FormatVersion2 || footer.Version > CurrentFormatVersion {
+			return common.ErrUnsupportedFormatVersion
+		}
+	default:
 		return common.ErrTableFileMagic
 	}
+	if len(p) < footer.Size() {
+		return common.ErrTableFileTooShort
+	}
+	p = p[len(p)-footer.Size():]
+	n := footer.MetaIndexHandle.DecodeFromBytesWithVersion(p, footer.Version)
+	if n == 0 || footer.IndexHandle.DecodeFromBytesWithVersion(p[n:], footer.Version) == 0 {
+		return common.ErrTableFileCorrupted
+	}
 	return nil
-}
\ No newline at end of file
+}
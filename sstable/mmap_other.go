@@ -0,0 +1,20 @@
+// Created on 2021/4/6 by @zzl
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package sstable
+
+import (
+	"errors"
+	"os"
+)
+
+var errMmapNotSupported = errors.New("mmap is not supported on this platform")
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errMmapNotSupported
+}
+
+func munmapFile(data []byte) error {
+	return errMmapNotSupported
+}
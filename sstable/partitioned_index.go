@@ -0,0 +1,145 @@
+// Created on 2021/4/12 by @zzl
+package sstable
+
+import (
+	"asukadb/common"
+	"asukadb/sstable/block"
+)
+
+// Iterates over the entries of the index, whether it is a single block or
+// split into partitions.
+type indexIterator interface {
+	Valid() bool
+	InternalKey() *common.InternalKey
+	Next()
+	Prev()
+	Seek(target interface{})
+	SeekToFirst()
+	SeekToLast()
+}
+
+// Iterates over the entries of a partitioned index.  The top-level index
+// is always in memory, the partitions are read when the iterator first
+// steps into them.
+type partitionedIndexIterator struct {
+	table           *SsTable
+	partitionHandle BlockHandle
+	partitionIter   *block.Iterator
+	topLevelIter    *block.Iterator
+	// Error of the table iterator, set when a partition fails to read
+	err *error
+}
+
+func (it *partitionedIndexIterator) Valid() bool {
+	return it.partitionIter != nil && it.partitionIter.Valid()
+}
+
+func (it *partitionedIndexIterator) InternalKey() *common.InternalKey {
+	return it.partitionIter.InternalKey()
+}
+
+func (it *partitionedIndexIterator) Next() {
+	it.partitionIter.Next()
+	it.skipEmptyPartitionsForward()
+}
+
+func (it *partitionedIndexIterator) Prev() {
+	it.partitionIter.Prev()
+	it.skipEmptyPartitionsBackward()
+}
+
+func (it *partitionedIndexIterator) Seek(target interface{}) {
+	// Each top-level entry is the last key of its partition, so the first
+	// partition whose entry is >= target holds the index entry we want.
+	it.topLevelIter.Seek(target)
+	it.initPartition()
+	if it.partitionIter != nil {
+		it.partitionIter.Seek(target)
+	}
+	it.skipEmptyPartitionsForward()
+}
+
+func (it *partitionedIndexIterator) SeekToFirst() {
+	it.topLevelIter.SeekToFirst()
+	it.initPartition()
+	if it.partitionIter != nil {
+		it.partitionIter.SeekToFirst()
+	}
+	it.skipEmptyPartitionsForward()
+}
+
+func (it *partitionedIndexIterator) SeekToLast() {
+	it.topLevelIter.SeekToLast()
+	it.initPartition()
+	if it.partitionIter != nil {
+		it.partitionIter.SeekToLast()
+	}
+	it.skipEmptyPartitionsBackward()
+}
+
+func (it *partitionedIndexIterator) initPartition() {
+	if !it.topLevelIter.Valid() {
+		it.partitionIter = nil
+		return
+	}
+	var index IndexBlockHandle
+	index.InternalKey = it.topLevelIter.InternalKey()
+	handle := index.GetBlockHandle(it.table.footer.Version)
+	if it.partitionIter != nil && it.partitionHandle == handle {
+		// already positioned in this partition
+		return
+	}
+	partition := it.table.readIndexPartition(handle)
+	if partition == nil {
+		*it.err = common.ErrTableFileCorrupted
+		it.partitionIter = nil
+		return
+	}
+	it.partitionIter = partition.NewIterator(it.table.cmp)
+	it.partitionHandle = handle
+}
+
+func (it *partitionedIndexIterator) skipEmptyPartitionsForward() {
+	for it.partitionIter == nil || !it.partitionIter.Valid() {
+		// Never step over a partition which failed to read
+		if *it.err != nil || !it.topLevelIter.Valid() {
+			it.partitionIter = nil
+			return
+		}
+		it.topLevelIter.Next()
+		it.initPartition()
+		if it.partitionIter != nil {
+			it.partitionIter.SeekToFirst()
+		}
+	}
+}
+
+func (it *partitionedIndexIterator) skipEmptyPartitionsBackward() {
+	for it.partitionIter == nil || !it.partitionIter.Valid() {
+		// Never step over a partition which failed to read
+		if *it.err != nil || !it.topLevelIter.Valid() {
+			it.partitionIter = nil
+			return
+		}
+		it.topLevelIter.Prev()
+		it.initPartition()
+		if it.partitionIter != nil {
+			it.partitionIter.SeekToLast()
+		}
+	}
+}
+
+// Returns the partition of the index, reading it on first use.
+func (table *SsTable) readIndexPartition(handle BlockHandle) *block.Block {
+	table.partitionsMu.Lock()
+	defer table.partitionsMu.Unlock()
+
+	if partition, ok := table.partitions[handle.Offset]; ok {
+		return partition
+	}
+	partition := table.readBlock(handle)
+	if partition != nil {
+		table.partitions[handle.Offset] = partition
+	}
+	return partition
+}
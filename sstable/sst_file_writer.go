@@ -0,0 +1,127 @@
+// Created on 2021/4/9 by @zzl
+package sstable
+
+import (
+	"asukadb/common"
+	"asukadb/options"
+	"encoding/binary"
+	"os"
+)
+
+// Version of the external tables written by SstFileWriter
+const ExternalSstFileVersion = 1
+
+// SstFileWriter builds tables offline which can be loaded into a database
+// by DB.IngestExternalFiles.  Keys must be added in strictly increasing
+// order, they are all written with sequence number 0 and get a global
+// sequence number when the table is ingested.
+type SstFileWriter struct {
+	builder  *TableBuilder
+	fileName string
+	lastKey  []byte
+	info     ExternalSstFileInfo
+}
+
+// Describes a table written by SstFileWriter
+type ExternalSstFileInfo struct {
+	FileName    string
+	SmallestKey []byte
+	LargestKey  []byte
+	NumEntries  uint64
+	FileSize    uint64
+}
+
+func NewSstFileWriter(fileName string, opts *options.Options) (*SstFileWriter, error) {
+	var writer SstFileWriter
+	writer.builder = NewTableBuilder(fileName, opts)
+	if writer.builder == nil {
+		return nil, common.ErrCreateFile
+	}
+	writer.builder.props.ExternalVersion = ExternalSstFileVersion
+	writer.fileName = fileName
+	return &writer, nil
+}
+
+func (writer *SstFileWriter) Put(key, value []byte) error {
+	return writer.add(common.TypeValue, key, value)
+}
+
+func (writer *SstFileWriter) Delete(key []byte) error {
+	return writer.add(common.TypeDeletion, key, nil)
+}
+
+func (writer *SstFileWriter) add(valueType common.ValueType, key, value []byte) error {
+	if writer.info.NumEntries > 0 && writer.builder.cmp.Compare(key, writer.lastKey) <= 0 {
+		return common.ErrKeysNotSorted
+	}
+	internalKey := common.NewInternalKey(0, valueType, key, value)
+	writer.builder.Add(internalKey)
+	if writer.builder.status != nil {
+		return writer.builder.status
+	}
+	if writer.info.NumEntries == 0 {
+		writer.info.SmallestKey = internalKey.UserKey
+	}
+	writer.lastKey = internalKey.UserKey
+	writer.info.NumEntries++
+	return nil
+}
+
+// Finishes the table, no more keys can be added afterwards.
+func (writer *SstFileWriter) Finish() (*ExternalSstFileInfo, error) {
+	if writer.info.NumEntries == 0 {
+		writer.builder.Finish()
+		os.Remove(writer.fileName)
+		return nil, common.ErrEmptyFile
+	}
+	err := writer.builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+	writer.info.FileName = writer.fileName
+	writer.info.LargestKey = writer.lastKey
+	writer.info.FileSize = writer.builder.FileSize()
+	return &writer.info, nil
+}
+
+// Rewrites the global sequence number of an external table in place, opts
+// are the options of the database ingesting it.
+func SetGlobalSeq(fileName string, seq uint64, opts *options.Options) error {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The file is written below, so it must not be mapped
+	noMmapOptions := *opts
+	noMmapOptions.UseMmapReads = false
+	var table SsTable
+	table.file = file
+	err = table.open(&noMmapOptions, nil)
+	if err != nil {
+		return err
+	}
+	if table.properties.ExternalVersion == 0 {
+		return common.ErrNotExternalFile
+	}
+	handle, ok := table.propertiesHandle()
+	if !ok {
+		return common.ErrTableFileCorrupted
+	}
+	p := make([]byte, handle.Size)
+	_, err = file.ReadAt(p, int64(handle.Offset))
+	if err != nil {
+		return err
+	}
+	offset := globalSeqOffset(p)
+	if offset < 0 {
+		return common.ErrTableFileCorrupted
+	}
+	binary.LittleEndian.PutUint64(p[offset:], seq)
+	_, err = file.WriteAt(p[offset:offset+8], int64(handle.Offset)+int64(offset))
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
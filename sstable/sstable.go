@@ -3,74 +3,265 @@ package sstable
 
 import (
 	"asukadb/common"
+	"asukadb/options"
+	"asukadb/ratelimit"
 	"asukadb/sstable/block"
-	"io"
+	"math"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
+var defaultReadOptions = *options.NewReadOptions()
+
+// Number of bytes currently mapped by all tables in the process,
+// checked against Options.MaxMmapSize before a table gets mapped.
+var mmapBytes int64
+
 type SsTable struct {
 	indexBlock *block.Block
 	metaIndexBlock *block.Block
 	footer     Footer
+	cmp        common.Comparator
 	file       *os.File
+	properties TableProperties
+	// Contents of the whole file if it is memory mapped, nil otherwise
+	data       []byte
+	// Index partitions read so far, keyed by their offset.  Only used
+	// when the index is partitioned, indexBlock is then the top-level index.
+	partitionsMu sync.Mutex
+	partitions   map[uint64]*block.Block
+	// Data blocks are shared through the cache if it is not nil
+	blockCache *BlockCache
+	cacheId    uint64
 }
 
-func Open(fileName string) (*SsTable, error) {
+// Opens the table, blockCache may be nil if data blocks should not
+// be cached.
+func Open(fileName string, opts *options.Options, blockCache *BlockCache) (*SsTable, error) {
 	var table SsTable
 	var err error
 	table.file, err = os.Open(fileName)
 	if err != nil {
 		return nil, err
 	}
-	stat, _ := table.file.Stat()
-	// Read the footer block
-	footerSize := int64(table.footer.Size())
-	if stat.Size() < footerSize {
-		return nil, common.ErrTableFileTooShort
+	err = table.open(opts, blockCache)
+	if err != nil {
+		table.Close()
+		return nil, err
 	}
+	return &table, nil
+}
 
-	_, err = table.file.Seek(-footerSize, io.SeekEnd)
+func (table *SsTable) open(opts *options.Options, blockCache *BlockCache) error {
+	stat, err := table.file.Stat()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = table.footer.DecodeFrom(table.file)
+	// Read the footer block, its layout depends on the format version
+	// so read as much as the largest one takes
+	footerSize := int64(VersionedFooterEncodedLength)
+	if stat.Size() < footerSize {
+		footerSize = stat.Size()
+	}
+	p := make([]byte, footerSize)
+	_, err = table.file.ReadAt(p, stat.Size()-footerSize)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	err = table.footer.DecodeFrom(p)
+	if err != nil {
+		return err
+	}
+	table.cmp = opts.Comparator
+	if table.cmp == nil {
+		table.cmp = common.BytewiseComparator
+	}
+	if opts.UseMmapReads {
+		table.mmap(stat.Size(), opts.MaxMmapSize)
+	}
+	if blockCache != nil && table.data == nil {
+		// blocks of a mapped table are not copied, there is nothing to cache
+		table.blockCache = blockCache
+		table.cacheId = blockCache.NewId()
 	}
 	// Read the index block and meta index block
 	table.indexBlock = table.readBlock(table.footer.IndexHandle)
-	//table.metaIndexBlock = table.readBlock(table.footer.MetaIndexHandle)
-	return &table, nil
+	if table.indexBlock == nil {
+		return common.ErrTableFileCorrupted
+	}
+	if table.footer.MetaIndexHandle.Size > 0 {
+		table.metaIndexBlock = table.readBlock(table.footer.MetaIndexHandle)
+		table.readProperties()
+	}
+	if name := table.properties.ComparatorName; name != "" && name != table.cmp.Name() {
+		return common.ErrComparatorMismatch
+	}
+	if table.properties.IndexType == IndexTypePartitioned {
+		table.partitions = make(map[uint64]*block.Block)
+	}
+	return nil
+}
+
+// Maps the whole file if the limit allows, otherwise the table keeps
+// reading blocks through the file.
+func (table *SsTable) mmap(size int64, limit int64) {
+	for {
+		used := atomic.LoadInt64(&mmapBytes)
+		if limit > 0 && used+size > limit {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&mmapBytes, used, used+size) {
+			break
+		}
+	}
+	data, err := mmapFile(table.file, size)
+	if err != nil {
+		atomic.AddInt64(&mmapBytes, -size)
+		return
+	}
+	table.data = data
+}
+
+// Releases the mapping and the file handle.  Blocks and iterators of the
+// table must not be used after Close.
+func (table *SsTable) Close() error {
+	if table.data != nil {
+		munmapFile(table.data)
+		atomic.AddInt64(&mmapBytes, -int64(len(table.data)))
+		table.data = nil
+	}
+	return table.file.Close()
 }
 
-func (table *SsTable) NewIterator() *Iterator {
+// Returns the format version the table was written in.
+func (table *SsTable) FormatVersion() uint32 {
+	return table.footer.Version
+}
+
+// Returns the properties recorded when the table was built.
+func (table *SsTable) Properties() *TableProperties {
+	return &table.properties
+}
+
+func (table *SsTable) readProperties() {
+	handle, ok := table.propertiesHandle()
+	if !ok {
+		return
+	}
+	propsBlock := table.readBlock(handle)
+	if propsBlock != nil {
+		table.properties.DecodeFrom(propsBlock)
+	}
+}
+
+func (table *SsTable) propertiesHandle() (BlockHandle, bool) {
+	if table.metaIndexBlock == nil {
+		return BlockHandle{}, false
+	}
+	// meta blocks are keyed by their names
+	it := table.metaIndexBlock.NewIterator(common.BytewiseComparator)
+	it.Seek([]byte(PropertiesBlockName))
+	if !it.Valid() || string(it.InternalKey().UserKey) != PropertiesBlockName {
+		return BlockHandle{}, false
+	}
+	var index MetaIndexBlockHandle
+	index.InternalKey = it.InternalKey()
+	return index.GetBlockHandle(), true
+}
+
+// Returns an iterator over the table, a nil ro means the default
+// read options.
+func (table *SsTable) NewIterator(ro *options.ReadOptions) *Iterator {
+	if ro == nil {
+		ro = &defaultReadOptions
+	}
 	var it Iterator
 	it.table = table
-	it.indexIter = table.indexBlock.NewIterator()
+	it.fillCache = ro.FillCache
+	it.rateLimiter = ro.RateLimiter
+	if table.properties.IndexType == IndexTypePartitioned {
+		it.indexIter = &partitionedIndexIterator{table: table, topLevelIter: table.indexBlock.NewIterator(table.cmp), err: &it.err}
+	} else {
+		it.indexIter = table.indexBlock.NewIterator(table.cmp)
+	}
 	return &it
 }
 
-func (table *SsTable) Get(key []byte) ([]byte, error) {
-	it := table.NewIterator()
-	it.Seek(key)
-	if it.Valid() {
+// Returns the newest value of the key, ignoring the entries newer than
+// the snapshot of ro if it has one.
+func (table *SsTable) Get(key []byte, ro *options.ReadOptions) ([]byte, error) {
+	seq := uint64(math.MaxUint64)
+	if ro != nil && ro.Snapshot != nil {
+		seq = ro.Snapshot.Sequence()
+	}
+	it := table.NewIterator(ro)
+	if !it.seekForGet(key) {
+		if it.Err() != nil {
+			return nil, it.Err()
+		}
+		return nil, common.ErrNotFound
+	}
+	// the versions of the key are ordered from the newest
+	for ; it.Valid(); it.Next() {
 		internalKey := it.InternalKey()
-		if common.UserKeyComparator(key, internalKey.UserKey) == 0 {
+		if table.cmp.Compare(key, internalKey.UserKey) != 0 {
+			break
+		}
+		if internalKey.Seq <= seq {
 			// matched
 			if internalKey.Type == common.TypeValue {
+				if table.data != nil {
+					// don't hand out references to the mapping, it may be
+					// unmapped once the table is closed
+					return append([]byte(nil), internalKey.UserValue...), nil
+				}
 				return internalKey.UserValue, nil
 			} else {
 				return nil, common.ErrDeletion
 			}
 		}
 	}
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
 	return nil, common.ErrNotFound
 }
 
+func (table *SsTable) readDataBlock(blockHandle BlockHandle, fillCache bool, rateLimiter *ratelimit.RateLimiter) *block.Block {
+	if table.blockCache != nil {
+		if dataBlock := table.blockCache.lookup(table.cacheId, blockHandle.Offset); dataBlock != nil {
+			return dataBlock
+		}
+	}
+	if rateLimiter != nil && table.data == nil {
+		rateLimiter.Request(int64(blockHandle.Size), ratelimit.PriorityLow)
+	}
+	dataBlock := table.readBlock(blockHandle)
+	if dataBlock == nil {
+		return nil
+	}
+	if table.properties.ExternalVersion > 0 {
+		// entries of an ingested table all carry the global sequence number
+		dataBlock.SetSeq(table.properties.GlobalSeq)
+	}
+	if table.blockCache != nil && fillCache {
+		table.blockCache.insert(table.cacheId, blockHandle.Offset, dataBlock)
+	}
+	return dataBlock
+}
+
 func (table *SsTable) readBlock(blockHandle BlockHandle) *block.Block {
+	if table.data != nil {
+		if blockHandle.Offset+blockHandle.Size > uint64(len(table.data)) {
+			return nil
+		}
+		return block.New(table.data[blockHandle.Offset : blockHandle.Offset+blockHandle.Size])
+	}
+
 	p := make([]byte, blockHandle.Size)
 	n, err := table.file.ReadAt(p, int64(blockHandle.Offset))
-	if err != nil || uint32(n) != blockHandle.Size {
+	if err != nil || uint64(n) != blockHandle.Size {
 		return nil
 	}
 
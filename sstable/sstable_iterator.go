@@ -3,6 +3,7 @@ package sstable
 
 import (
 	"asukadb/common"
+	"asukadb/ratelimit"
 	"asukadb/sstable/block"
 )
 
@@ -10,7 +11,34 @@ type Iterator struct {
 	table           *SsTable
 	dataBlockHandle BlockHandle
 	dataIter        *block.Iterator
-	indexIter       *block.Iterator
+	indexIter       indexIterator
+	fillCache       bool
+	rateLimiter     *ratelimit.RateLimiter
+	cleanups        []func()
+	// First data block or index partition which failed to read, the
+	// iterator stays invalid once it is set
+	err error
+}
+
+// Registers a function to run when the iterator is closed.
+func (it *Iterator) RegisterCleanup(f func()) {
+	it.cleanups = append(it.cleanups, f)
+}
+
+// Runs the registered cleanup functions, the iterator must not be used
+// afterwards.  It is safe to call Close more than once.
+func (it *Iterator) Close() {
+	it.dataIter = nil
+	for _, f := range it.cleanups {
+		f()
+	}
+	it.cleanups = nil
+}
+
+// Returns the error which ended the iteration early, or nil if the
+// iterator reached the end of the table.
+func (it *Iterator) Err() error {
+	return it.err
 }
 
 // Returns true iff the iterator is positioned at a valid node.
@@ -62,6 +90,23 @@ func (it *Iterator) Seek(target []byte) {
 	it.skipEmptyDataBlocksForward()
 }
 
+// Like Seek, but may use the hash index of the data block.  Returns false
+// if target is known not to be in the table.
+func (it *Iterator) seekForGet(target []byte) bool {
+	it.indexIter.Seek(target)
+	it.initDataBlock()
+	if it.dataIter == nil {
+		return false
+	}
+	// The index entry is >= target and < the keys of the next block, so if
+	// target is not in this block, it is not in the table either.
+	if !it.dataIter.SeekForGet(target) {
+		return false
+	}
+	it.skipEmptyDataBlocksForward()
+	return it.Valid()
+}
+
 // Position at the first entry in list.
 // Final state of iterator is Valid() iff list is not empty.
 func (it *Iterator) SeekToFirst() {
@@ -90,13 +135,19 @@ func (it *Iterator) initDataBlock() {
 	} else {
 		var index IndexBlockHandle
 		index.InternalKey = it.indexIter.InternalKey()
-		tmpBlockHandle := index.GetBlockHandle()
+		tmpBlockHandle := index.GetBlockHandle(it.table.footer.Version)
 
 		if it.dataIter != nil && it.dataBlockHandle == tmpBlockHandle {
 			// data_iter_ is already constructed with this iterator, so
 			// no need to change anything
 		} else {
-			it.dataIter = it.table.readBlock(tmpBlockHandle).NewIterator()
+			dataBlock := it.table.readDataBlock(tmpBlockHandle, it.fillCache, it.rateLimiter)
+			if dataBlock == nil {
+				it.err = common.ErrTableFileCorrupted
+				it.dataIter = nil
+				return
+			}
+			it.dataIter = dataBlock.NewIterator(it.table.cmp)
 			it.dataBlockHandle = tmpBlockHandle
 		}
 	}
@@ -104,7 +155,8 @@ func (it *Iterator) initDataBlock() {
 
 func (it *Iterator) skipEmptyDataBlocksForward() {
 	for it.dataIter == nil || !it.dataIter.Valid() {
-		if !it.indexIter.Valid() {
+		// Never step over a block which failed to read
+		if it.err != nil || !it.indexIter.Valid() {
 			it.dataIter = nil
 			return
 		}
@@ -118,7 +170,8 @@ func (it *Iterator) skipEmptyDataBlocksForward() {
 
 func (it *Iterator) skipEmptyDataBlocksBackward() {
 	for it.dataIter == nil || !it.dataIter.Valid() {
-		if !it.indexIter.Valid() {
+		// Never step over a block which failed to read
+		if it.err != nil || !it.indexIter.Valid() {
 			it.dataIter = nil
 			return
 		}
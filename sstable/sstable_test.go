@@ -3,13 +3,21 @@ package sstable
 
 import (
 	"asukadb/common"
+	"asukadb/options"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
 func Test_SsTable(t *testing.T) {
-	tableName := common.GetTableFileName("asuka", 000)
+	tableName := common.GetTableFileName("asuka", 7)
+	defer os.Remove(tableName)
 	println(tableName)
-	builder := NewTableBuilder(tableName)
+	builder := NewTableBuilder(tableName, options.New())
 	item := common.NewInternalKey(1, common.TypeValue, []byte("123"), []byte("1234"))
 	builder.Add(item)
 	item = common.NewInternalKey(2, common.TypeValue, []byte("124"), []byte("1245"))
@@ -18,11 +26,11 @@ func Test_SsTable(t *testing.T) {
 	builder.Add(item)
 	builder.Finish()
 
-	table, err := Open(tableName)
+	table, err := Open(tableName, options.New(), nil)
 	if err != nil {
 		t.Fail()
 	}
-	it := table.NewIterator()
+	it := table.NewIterator(nil)
 	it.Seek([]byte("1244"))
 	if it.Valid() {
 		if string(it.InternalKey().UserKey) != "125" {
@@ -31,4 +39,499 @@ func Test_SsTable(t *testing.T) {
 	} else {
 		t.Fail()
 	}
-}
\ No newline at end of file
+}
+
+func Test_SsTableProperties(t *testing.T) {
+	tableName := common.GetTableFileName("asuka", 1)
+	defer os.Remove(tableName)
+	builder := NewTableBuilder(tableName, options.New())
+	builder.Add(common.NewInternalKey(5, common.TypeValue, []byte("123"), []byte("1234")))
+	builder.Add(common.NewInternalKey(3, common.TypeDeletion, []byte("124"), nil))
+	builder.Add(common.NewInternalKey(7, common.TypeValue, []byte("125"), []byte("02")))
+	builder.Finish()
+
+	table, err := Open(tableName, options.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := table.Properties()
+	if props.NumEntries != 3 || props.NumDeletions != 1 || props.NumDataBlocks != 1 {
+		t.Fatalf("unexpected counts: %+v", props)
+	}
+	if props.RawKeySize != 9 || props.RawValueSize != 6 {
+		t.Fatalf("unexpected raw sizes: %+v", props)
+	}
+	if props.SmallestSeq != 3 || props.LargestSeq != 7 {
+		t.Fatalf("unexpected sequence numbers: %+v", props)
+	}
+	if props.DataSize == 0 || props.IndexSize == 0 || props.CreationTime == 0 {
+		t.Fatalf("unexpected sizes: %+v", props)
+	}
+	if props.ComparatorName != common.UserKeyComparatorName || props.CompressionName != NoCompressionName {
+		t.Fatalf("unexpected names: %+v", props)
+	}
+}
+
+func Test_SsTableShortIndexKeys(t *testing.T) {
+	tableName := common.GetTableFileName("asuka", 2)
+	defer os.Remove(tableName)
+	padding := bytes.Repeat([]byte("x"), 192)
+	keyOf := func(i int) []byte {
+		return append([]byte(fmt.Sprintf("%08d", i*2)), padding...)
+	}
+	builder := NewTableBuilder(tableName, options.New())
+	for i := 0; i < 1000; i++ {
+		builder.Add(common.NewInternalKey(uint64(i), common.TypeValue, keyOf(i), []byte("v")))
+	}
+	builder.Finish()
+
+	table, err := Open(tableName, options.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := table.Properties()
+	if props.IndexSize*10 > props.DataSize {
+		t.Fatalf("index block is too large: %d vs %d", props.IndexSize, props.DataSize)
+	}
+	it := table.NewIterator(nil)
+	for i := 0; i < 1000; i++ {
+		// exact match
+		it.Seek(keyOf(i))
+		if !it.Valid() || !bytes.Equal(it.Key(), keyOf(i)) {
+			t.Fatalf("seek %d failed", i)
+		}
+		// between two keys, must land on the next one
+		it.Seek([]byte(fmt.Sprintf("%08d", i*2+1)))
+		if i == 999 {
+			if it.Valid() {
+				t.Fatalf("seek past the last key should be invalid")
+			}
+		} else if !it.Valid() || !bytes.Equal(it.Key(), keyOf(i+1)) {
+			t.Fatalf("seek after %d failed", i)
+		}
+	}
+}
+
+func Test_FooterLargeOffsets(t *testing.T) {
+	var footer Footer
+	footer.MetaIndexHandle = BlockHandle{Offset: 5 << 32, Size: 1234}
+	footer.IndexHandle = BlockHandle{Offset: 1<<63 + 7, Size: 1 << 33}
+	footer.Version = CurrentFormatVersion
+	var buf bytes.Buffer
+	if err := footer.EncodeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != VersionedFooterEncodedLength {
+		t.Fatalf("footer should be padded to %d bytes, got %d", VersionedFooterEncodedLength, buf.Len())
+	}
+	var decoded Footer
+	if err := decoded.DecodeFrom(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != footer {
+		t.Fatalf("got %+v, want %+v", decoded, footer)
+	}
+}
+
+func Test_SsTableMmap(t *testing.T) {
+	tableName := common.GetTableFileName("asuka", 3)
+	defer os.Remove(tableName)
+	builder := NewTableBuilder(tableName, options.New())
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%08d", i))
+		builder.Add(common.NewInternalKey(uint64(i), common.TypeValue, key, key))
+	}
+	builder.Finish()
+
+	opts := options.New()
+	opts.UseMmapReads = true
+	table, err := Open(tableName, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.data == nil {
+		t.Fatal("table should be memory mapped")
+	}
+	value, err := table.Get([]byte("00000123"), nil)
+	if err != nil || string(value) != "00000123" {
+		t.Fatal(err, string(value))
+	}
+	count := 0
+	it := table.NewIterator(nil)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		count++
+	}
+	if count != 1000 {
+		t.Fatalf("got %d entries", count)
+	}
+	table.Close()
+	if string(value) != "00000123" {
+		t.Fatal("value must stay valid after the table is closed")
+	}
+
+	// falls back to pread once the limit is reached
+	opts.MaxMmapSize = 1
+	table, err = Open(tableName, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.data != nil {
+		t.Fatal("table should not be memory mapped")
+	}
+	value, err = table.Get([]byte("00000456"), nil)
+	if err != nil || string(value) != "00000456" {
+		t.Fatal(err, string(value))
+	}
+	table.Close()
+}
+
+func Test_SstFileWriter(t *testing.T) {
+	tableName := common.GetTableFileName("asuka", 4)
+	defer os.Remove(tableName)
+	writer, err := NewSstFileWriter(tableName, options.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Put([]byte("b"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Put([]byte("a"), []byte("2")); err != common.ErrKeysNotSorted {
+		t.Fatalf("unsorted keys must be rejected, got %v", err)
+	}
+	if err = writer.Put([]byte("b"), []byte("3")); err != common.ErrKeysNotSorted {
+		t.Fatalf("duplicate keys must be rejected, got %v", err)
+	}
+	if err = writer.Delete([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := writer.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(info.SmallestKey) != "b" || string(info.LargestKey) != "c" || info.NumEntries != 2 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+
+	if err = SetGlobalSeq(tableName, 42, options.New()); err != nil {
+		t.Fatal(err)
+	}
+	table, err := Open(tableName, options.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	if table.Properties().GlobalSeq != 42 {
+		t.Fatalf("unexpected global seq %d", table.Properties().GlobalSeq)
+	}
+	it := table.NewIterator(nil)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if it.InternalKey().Seq != 42 {
+			t.Fatalf("entry %s has seq %d", it.Key(), it.InternalKey().Seq)
+		}
+	}
+}
+
+func Test_SsTablePartitionedIndex(t *testing.T) {
+	tableName := common.GetTableFileName("asuka", 5)
+	defer os.Remove(tableName)
+	opts := options.New()
+	opts.PartitionedIndex = true
+	opts.IndexPartitionSize = 256
+	keyOf := func(i int) []byte {
+		return []byte(fmt.Sprintf("%08d", i*2))
+	}
+	builder := NewTableBuilder(tableName, opts)
+	for i := 0; i < 20000; i++ {
+		builder.Add(common.NewInternalKey(uint64(i), common.TypeValue, keyOf(i), keyOf(i)))
+	}
+	builder.Finish()
+
+	table, err := Open(tableName, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	props := table.Properties()
+	if props.IndexType != IndexTypePartitioned || props.NumIndexPartitions < 2 {
+		t.Fatalf("index should be partitioned: %+v", props)
+	}
+	if len(table.partitions) != 0 {
+		t.Fatal("partitions must be read lazily")
+	}
+	value, err := table.Get(keyOf(12345), nil)
+	if err != nil || !bytes.Equal(value, keyOf(12345)) {
+		t.Fatal(err, string(value))
+	}
+	if len(table.partitions) != 1 {
+		t.Fatalf("expected one partition to be read, got %d", len(table.partitions))
+	}
+	it := table.NewIterator(nil)
+	for i := 0; i < 20000; i += 7 {
+		it.Seek([]byte(fmt.Sprintf("%08d", i*2+1)))
+		if i == 19999 {
+			if it.Valid() {
+				t.Fatal("seek past the last key should be invalid")
+			}
+		} else if !it.Valid() || !bytes.Equal(it.Key(), keyOf(i+1)) {
+			t.Fatalf("seek after %d failed", i)
+		}
+	}
+	count := 0
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		count++
+	}
+	if count != 20000 {
+		t.Fatalf("got %d entries backwards", count)
+	}
+}
+
+func Test_SsTableHashIndex(t *testing.T) {
+	tableName := common.GetTableFileName("asuka", 6)
+	defer os.Remove(tableName)
+	opts := options.New()
+	opts.DataBlockHashIndex = true
+	builder := NewTableBuilder(tableName, opts)
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("%08d", i*2))
+		builder.Add(common.NewInternalKey(uint64(i), common.TypeValue, key, key))
+	}
+	builder.Finish()
+
+	table, err := Open(tableName, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("%08d", i*2))
+		value, err := table.Get(key, nil)
+		if err != nil || !bytes.Equal(value, key) {
+			t.Fatal(i, err, string(value))
+		}
+		_, err = table.Get([]byte(fmt.Sprintf("%08d", i*2+1)), nil)
+		if err != common.ErrNotFound {
+			t.Fatal(i, err)
+		}
+	}
+}
+
+func Test_SsTableLegacyFormat(t *testing.T) {
+	// written before the footer had a format version
+	table, err := Open(common.GetTableFileName("asuka", 0), options.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	if table.FormatVersion() != LegacyFormatVersion {
+		t.Fatalf("unexpected format version %d", table.FormatVersion())
+	}
+	value, err := table.Get([]byte("124"), nil)
+	if err != nil || string(value) != "1245" {
+		t.Fatal(err, string(value))
+	}
+	count := 0
+	it := table.NewIterator(nil)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		count++
+	}
+	if count != 3 {
+		t.Fatalf("got %d entries", count)
+	}
+}
+
+func Test_SsTableFormatVersion1(t *testing.T) {
+	tableName := common.GetTableFileName("asuka", 8)
+	defer os.Remove(tableName)
+	builder := NewTableBuilder(tableName, options.New())
+	builder.Add(common.NewInternalKey(1, common.TypeValue, []byte("123"), []byte("1234")))
+	builder.Finish()
+
+	// rewrite the footer in the layout used before it recorded the version
+	p, err := ioutil.ReadFile(tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var footer Footer
+	if err = footer.DecodeFrom(p); err != nil {
+		t.Fatal(err)
+	}
+	p = p[:len(p)-VersionedFooterEncodedLength]
+	handles := make([]byte, 2*MaxEncodedLength+8)
+	n := copy(handles, footer.MetaIndexHandle.EncodeToBytes())
+	copy(handles[n:], footer.IndexHandle.EncodeToBytes())
+	binary.LittleEndian.PutUint64(handles[2*MaxEncodedLength:], MagicNumber)
+	if err = ioutil.WriteFile(tableName, append(p, handles...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := Open(tableName, options.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	if table.FormatVersion() != FormatVersion1 {
+		t.Fatalf("unexpected format version %d", table.FormatVersion())
+	}
+	value, err := table.Get([]byte("123"), nil)
+	if err != nil || string(value) != "1234" {
+		t.Fatal(err, string(value))
+	}
+}
+
+func Test_BlockCache(t *testing.T) {
+	tableName := common.GetTableFileName("asuka", 9)
+	defer os.Remove(tableName)
+	builder := NewTableBuilder(tableName, options.New())
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%08d", i))
+		builder.Add(common.NewInternalKey(uint64(i), common.TypeValue, key, key))
+	}
+	builder.Finish()
+
+	opts := options.New()
+	opts.BlockCacheCapacity = 1 << 20
+	cache := NewBlockCache(opts)
+	table, err := Open(tableName, opts, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	// reads that don't fill the cache leave it untouched
+	ro := options.NewReadOptions()
+	ro.FillCache = false
+	if value, err := table.Get([]byte("00000123"), ro); err != nil || string(value) != "00000123" {
+		t.Fatal(err, string(value))
+	}
+	if stats := cache.Stats(); stats.Inserts != 0 || stats.Misses != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	table.Get([]byte("00000123"), nil)
+	table.Get([]byte("00000124"), nil)
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Inserts != 1 || stats.Usage == 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// a capacity of a single block evicts on every new block
+	opts.BlockCacheCapacity = stats.Usage
+	small := NewBlockCache(opts)
+	table2, err := Open(tableName, opts, small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table2.Close()
+	count := 0
+	it := table2.NewIterator(nil)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		count++
+	}
+	if count != 1000 {
+		t.Fatalf("got %d entries", count)
+	}
+	stats = small.Stats()
+	if stats.Evictions == 0 || stats.Usage > stats.Capacity {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func Test_SsTableReadError(t *testing.T) {
+	tableName := common.GetTableFileName("asuka", 10)
+	defer os.Remove(tableName)
+	builder := NewTableBuilder(tableName, options.New())
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%08d", i))
+		builder.Add(common.NewInternalKey(uint64(i), common.TypeValue, key, key))
+	}
+	builder.Finish()
+	table, err := Open(tableName, options.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	// the data blocks past the middle of the file can no longer be read
+	if err = os.Truncate(tableName, int64(builder.FileSize()/2)); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	it := table.NewIterator(nil)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		count++
+	}
+	if count == 0 || count >= 1000 || it.Err() == nil {
+		t.Fatal("the iteration should stop at the lost block", count, it.Err())
+	}
+	if _, err = table.Get([]byte("00000999"), nil); err != common.ErrTableFileCorrupted {
+		t.Fatal(err)
+	}
+}
+
+func Test_SsTablePartitionReadError(t *testing.T) {
+	tableName := common.GetTableFileName("asuka", 11)
+	defer os.Remove(tableName)
+	opts := options.New()
+	opts.PartitionedIndex = true
+	opts.IndexPartitionSize = 256
+	builder := NewTableBuilder(tableName, opts)
+	for i := 0; i < 20000; i++ {
+		key := []byte(fmt.Sprintf("%08d", i))
+		builder.Add(common.NewInternalKey(uint64(i), common.TypeValue, key, key))
+	}
+	builder.Finish()
+	table, err := Open(tableName, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	// the handle of the last partition points past the end of the file
+	topLevelIter := table.indexBlock.NewIterator(table.cmp)
+	topLevelIter.SeekToLast()
+	var index IndexBlockHandle
+	index.InternalKey = topLevelIter.InternalKey()
+	if err = os.Truncate(tableName, int64(index.GetBlockHandle(table.footer.Version).Offset)); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	it := table.NewIterator(nil)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		count++
+	}
+	if count == 0 || count >= 20000 || it.Err() != common.ErrTableFileCorrupted {
+		t.Fatal("the iteration should stop at the lost partition", count, it.Err())
+	}
+	it = table.NewIterator(nil)
+	if it.SeekToLast(); it.Valid() || it.Err() != common.ErrTableFileCorrupted {
+		t.Fatal("the iteration should not skip the lost partition", it.Err())
+	}
+	if _, err = table.Get([]byte("00019999"), nil); err != common.ErrTableFileCorrupted {
+		t.Fatal(err)
+	}
+	if value, err := table.Get([]byte("00000000"), nil); err != nil || string(value) != "00000000" {
+		t.Fatal(err, string(value))
+	}
+}
+
+func Test_TableBuilderWriteError(t *testing.T) {
+	tableName := common.GetTableFileName("asuka", 12)
+	defer os.Remove(tableName)
+	builder := NewTableBuilder(tableName, options.New())
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%08d", i))
+		builder.Add(common.NewInternalKey(uint64(i), common.TypeValue, key, key))
+	}
+	// the writes of the following blocks fail
+	builder.file.Close()
+	for i := 1000; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("%08d", i))
+		builder.Add(common.NewInternalKey(uint64(i), common.TypeValue, key, key))
+	}
+	if err := builder.Finish(); !errors.Is(err, os.ErrClosed) {
+		t.Fatal("the first write error should be returned", err)
+	}
+	if _, err := Open(tableName, options.New(), nil); err == nil {
+		t.Fatal("the table has no footer")
+	}
+}
@@ -3,36 +3,61 @@ package sstable
 
 import (
 	"asukadb/common"
+	"asukadb/options"
+	"asukadb/ratelimit"
 	"asukadb/sstable/block"
 	"os"
+	"time"
 )
 
 const MaxBlockSize = 1 << 12
 
 type TableBuilder struct {
+	opts               *options.Options
+	cmp                common.Comparator
 	file               *os.File
-	offset             uint32
-	numEntries         int32
+	offset             uint64
+	props              TableProperties
 	dataBlockBuilder   block.BlockBuilder
 	indexBlockBuilder  block.BlockBuilder
 	metaIndexBlockBuilder block.BlockBuilder
 	pendingIndexEntry  bool
 	pendingIndexHandle IndexBlockHandle
+	// Top-level index of a partitioned index, each entry points to a
+	// partition holding part of the index entries
+	topLevelIndexBuilder block.BlockBuilder
+	lastIndexKey       *common.InternalKey
+	// Priority of the writes charged to opts.RateLimiter
+	ioPriority         ratelimit.Priority
 	status             error
 }
 
-func NewTableBuilder(fileName string) *TableBuilder {
+func NewTableBuilder(fileName string, opts *options.Options) *TableBuilder {
 	var builder TableBuilder
 	var err error
+	builder.opts = opts
+	builder.cmp = opts.Comparator
+	if builder.cmp == nil {
+		builder.cmp = common.BytewiseComparator
+	}
 	builder.file, err = os.Create(fileName)
 	if err != nil {
 		return nil
 	}
+	if opts.DataBlockHashIndex {
+		builder.dataBlockBuilder.EnableHashIndex(opts.DataBlockHashTableUtilRatio)
+	}
 	builder.pendingIndexEntry = false
 	return &builder
 }
 
-func (builder *TableBuilder) FileSize() uint32 {
+// Sets the priority of the writes of the table if they are rate limited,
+// ratelimit.PriorityLow by default.
+func (builder *TableBuilder) SetIOPriority(pri ratelimit.Priority) {
+	builder.ioPriority = pri
+}
+
+func (builder *TableBuilder) FileSize() uint64 {
 	return builder.offset
 }
 
@@ -41,14 +66,22 @@ func (builder *TableBuilder) Add(internalKey *common.InternalKey) {
 		return
 	}
 	if builder.pendingIndexEntry {
-		builder.indexBlockBuilder.Add(builder.pendingIndexHandle.InternalKey)
+		// We do not emit the index entry for a block until we have seen the
+		// first key for the next data block.  This allows us to use shorter
+		// keys in the index block.  For example, consider a block boundary
+		// between the keys "the quick brown fox" and "the who".  We can use
+		// "the r" as the key for the index block entry since it is >= all
+		// entries in the first block and < all entries in subsequent blocks.
+		lastKey := builder.pendingIndexHandle.InternalKey
+		lastKey.UserKey = builder.cmp.FindShortestSeparator(lastKey.UserKey, internalKey.UserKey)
+		builder.addIndexEntry(lastKey)
 		builder.pendingIndexEntry = false
 	}
 	// todo : filter block
 
 	builder.pendingIndexHandle.InternalKey = internalKey
 
-	builder.numEntries++
+	builder.props.add(internalKey)
 	builder.dataBlockBuilder.Add(internalKey)
 	if builder.dataBlockBuilder.CurrentSizeEstimate() > MaxBlockSize {
 		builder.flush()
@@ -61,8 +94,11 @@ func (builder *TableBuilder) flush() {
 	}
 	orgKey := builder.pendingIndexHandle.InternalKey
 	builder.pendingIndexHandle.InternalKey = common.NewInternalKey(orgKey.Seq, orgKey.Type, orgKey.UserKey, nil)
-	builder.pendingIndexHandle.SetBlockHandle(builder.writeblock(&builder.dataBlockBuilder))
+	blockHandle := builder.writeblock(&builder.dataBlockBuilder)
+	builder.pendingIndexHandle.SetBlockHandle(blockHandle)
 	builder.pendingIndexEntry = true
+	builder.props.NumDataBlocks++
+	builder.props.DataSize += blockHandle.Size
 }
 
 func (builder *TableBuilder) Finish() error {
@@ -72,16 +108,80 @@ func (builder *TableBuilder) Finish() error {
 
 	// write index block
 	if builder.pendingIndexEntry {
-		builder.indexBlockBuilder.Add(builder.pendingIndexHandle.InternalKey)
+		lastKey := builder.pendingIndexHandle.InternalKey
+		lastKey.UserKey = builder.cmp.FindShortSuccessor(lastKey.UserKey)
+		builder.addIndexEntry(lastKey)
 		builder.pendingIndexEntry = false
 	}
 	var footer Footer
-	footer.IndexHandle = builder.writeblock(&builder.indexBlockBuilder)
+	footer.Version = CurrentFormatVersion
+	if builder.opts.PartitionedIndex {
+		builder.flushIndexPartition()
+		footer.IndexHandle = builder.writeblock(&builder.topLevelIndexBuilder)
+		builder.props.IndexType = IndexTypePartitioned
+		builder.props.TopLevelIndexSize = footer.IndexHandle.Size
+	} else {
+		footer.IndexHandle = builder.writeblock(&builder.indexBlockBuilder)
+		builder.props.IndexType = IndexTypeBinarySearch
+	}
+
+	// write properties block
+	builder.props.IndexSize += footer.IndexHandle.Size
+	builder.props.CompressionName = NoCompressionName
+	builder.props.FilterPolicyName = NoFilterPolicyName
+	builder.props.ComparatorName = builder.cmp.Name()
+	builder.props.CreationTime = uint64(time.Now().Unix())
+	var propsBlockBuilder block.BlockBuilder
+	builder.props.EncodeTo(&propsBlockBuilder)
+	propsHandle := builder.writeblock(&propsBlockBuilder)
+
+	// write meta index block
+	var metaIndex MetaIndexBlockHandle
+	metaIndex.InternalKey = common.NewInternalKey(0, common.TypeValue, []byte(PropertiesBlockName), nil)
+	metaIndex.SetBlockHandle(propsHandle)
+	builder.metaIndexBlockBuilder.Add(metaIndex.InternalKey)
+	footer.MetaIndexHandle = builder.writeblock(&builder.metaIndexBlockBuilder)
 
 	// write footer block
-	footer.EncodeTo(builder.file)
-	builder.file.Close()
-	return nil
+	builder.requestWrite(VersionedFooterEncodedLength)
+	if builder.status == nil {
+		builder.status = footer.EncodeTo(builder.file)
+	}
+	if builder.status == nil {
+		builder.status = builder.file.Sync()
+	}
+	if err := builder.file.Close(); builder.status == nil {
+		builder.status = err
+	}
+	return builder.status
+}
+
+func (builder *TableBuilder) addIndexEntry(indexKey *common.InternalKey) {
+	builder.indexBlockBuilder.Add(indexKey)
+	builder.lastIndexKey = indexKey
+	if builder.opts.PartitionedIndex && builder.indexBlockBuilder.CurrentSizeEstimate() >= builder.opts.IndexPartitionSize {
+		builder.flushIndexPartition()
+	}
+}
+
+// Writes the index entries added so far as a partition, and points to it
+// from the top-level index by the last key of the partition.
+func (builder *TableBuilder) flushIndexPartition() {
+	if builder.indexBlockBuilder.Empty() {
+		return
+	}
+	partitionHandle := builder.writeblock(&builder.indexBlockBuilder)
+	var index IndexBlockHandle
+	index.InternalKey = common.NewInternalKey(builder.lastIndexKey.Seq, builder.lastIndexKey.Type, builder.lastIndexKey.UserKey, nil)
+	index.SetBlockHandle(partitionHandle)
+	builder.topLevelIndexBuilder.Add(index.InternalKey)
+	builder.props.NumIndexPartitions++
+	builder.props.IndexSize += partitionHandle.Size
+}
+
+// Returns the properties of the table built so far.
+func (builder *TableBuilder) Properties() TableProperties {
+	return builder.props
 }
 
 func (builder *TableBuilder) writeblock(blockBuilder *block.BlockBuilder) BlockHandle {
@@ -89,10 +189,23 @@ func (builder *TableBuilder) writeblock(blockBuilder *block.BlockBuilder) BlockH
 	// todo : compress, crc
 	var blockHandle BlockHandle
 	blockHandle.Offset = builder.offset
-	blockHandle.Size = uint32(len(content))
-	builder.offset += uint32(len(content))
-	_, builder.status = builder.file.Write(content)
-	builder.file.Sync()
+	blockHandle.Size = uint64(len(content))
+	builder.offset += uint64(len(content))
+	builder.requestWrite(len(content))
+	// keep the first error, the table is broken from there on
+	if builder.status == nil {
+		_, builder.status = builder.file.Write(content)
+	}
+	if builder.status == nil {
+		builder.status = builder.file.Sync()
+	}
 	blockBuilder.Reset()
 	return blockHandle
-}
\ No newline at end of file
+}
+
+// Waits until the rate limiter, if any, lets n bytes be written.
+func (builder *TableBuilder) requestWrite(n int) {
+	if builder.opts.RateLimiter != nil {
+		builder.opts.RateLimiter.Request(int64(n), builder.ioPriority)
+	}
+}
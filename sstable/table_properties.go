@@ -0,0 +1,193 @@
+// Created on 2021/4/2 by @zzl
+package sstable
+
+import (
+	"asukadb/common"
+	"asukadb/sstable/block"
+	"encoding/binary"
+)
+
+// Name of the properties block in the meta index block
+const PropertiesBlockName = "asuka.properties"
+
+const (
+	NoCompressionName  = "NoCompression"
+	NoFilterPolicyName = ""
+)
+
+// Property names, they must be added to the properties block in sorted order
+const (
+	propComparator         = "asuka.comparator"
+	propCompression        = "asuka.compression"
+	propCreationTime       = "asuka.creation.time"
+	propDataSize           = "asuka.data.size"
+	propGlobalSeq          = "asuka.external.global.seq"
+	propExternalVersion    = "asuka.external.version"
+	propFilterPolicy       = "asuka.filter.policy"
+	propIndexSize          = "asuka.index.size"
+	propIndexType          = "asuka.index.type"
+	propLargestSeq         = "asuka.largest.seq"
+	propNumDataBlocks      = "asuka.num.data.blocks"
+	propNumDeletions       = "asuka.num.deletions"
+	propNumEntries         = "asuka.num.entries"
+	propNumIndexPartitions = "asuka.num.index.partitions"
+	propRawKeySize         = "asuka.raw.key.size"
+	propRawValueSize       = "asuka.raw.value.size"
+	propSmallestSeq        = "asuka.smallest.seq"
+	propTopLevelIndexSize  = "asuka.top.level.index.size"
+)
+
+// Layouts of the index of a table
+const (
+	// A single index block searched by binary search
+	IndexTypeBinarySearch = iota
+	// The index is split into partitions, which are located through a
+	// small top-level index
+	IndexTypePartitioned
+)
+
+// TableProperties describes what is inside an sstable without scanning it.
+type TableProperties struct {
+	NumEntries         uint64
+	NumDeletions       uint64
+	NumDataBlocks      uint64
+	RawKeySize         uint64 // Total size of all user keys
+	RawValueSize       uint64 // Total size of all user values
+	DataSize           uint64 // Total size of all data blocks
+	IndexSize          uint64 // Size of the index block, or all partitions and the top-level index
+	IndexType          uint64
+	NumIndexPartitions uint64
+	TopLevelIndexSize  uint64
+	SmallestSeq        uint64
+	LargestSeq         uint64
+	CompressionName    string
+	FilterPolicyName   string
+	ComparatorName     string
+	CreationTime       uint64 // Unix time in seconds
+	// Non-zero for tables written by SstFileWriter
+	ExternalVersion uint64
+	// Sequence number assigned to every entry of an external table once
+	// it is ingested.  It is stored as a fixed64 so that it can be
+	// rewritten in place.
+	GlobalSeq uint64
+}
+
+// Track the stats of an internal key which is added to the table.
+func (props *TableProperties) add(internalKey *common.InternalKey) {
+	if props.NumEntries == 0 || internalKey.Seq < props.SmallestSeq {
+		props.SmallestSeq = internalKey.Seq
+	}
+	if props.NumEntries == 0 || internalKey.Seq > props.LargestSeq {
+		props.LargestSeq = internalKey.Seq
+	}
+	props.NumEntries++
+	if internalKey.Type == common.TypeDeletion {
+		props.NumDeletions++
+	}
+	props.RawKeySize += uint64(len(internalKey.UserKey))
+	props.RawValueSize += uint64(len(internalKey.UserValue))
+}
+
+func (props *TableProperties) EncodeTo(blockBuilder *block.BlockBuilder) {
+	addString := func(name, value string) {
+		blockBuilder.Add(common.NewInternalKey(0, common.TypeValue, []byte(name), []byte(value)))
+	}
+	addUint := func(name string, value uint64) {
+		p := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(p, value)
+		blockBuilder.Add(common.NewInternalKey(0, common.TypeValue, []byte(name), p[:n]))
+	}
+	addString(propComparator, props.ComparatorName)
+	addString(propCompression, props.CompressionName)
+	addUint(propCreationTime, props.CreationTime)
+	addUint(propDataSize, props.DataSize)
+	if props.ExternalVersion > 0 {
+		p := make([]byte, 8)
+		binary.LittleEndian.PutUint64(p, props.GlobalSeq)
+		blockBuilder.Add(common.NewInternalKey(0, common.TypeValue, []byte(propGlobalSeq), p))
+		addUint(propExternalVersion, props.ExternalVersion)
+	}
+	addString(propFilterPolicy, props.FilterPolicyName)
+	addUint(propIndexSize, props.IndexSize)
+	addUint(propIndexType, props.IndexType)
+	addUint(propLargestSeq, props.LargestSeq)
+	addUint(propNumDataBlocks, props.NumDataBlocks)
+	addUint(propNumDeletions, props.NumDeletions)
+	addUint(propNumEntries, props.NumEntries)
+	addUint(propNumIndexPartitions, props.NumIndexPartitions)
+	addUint(propRawKeySize, props.RawKeySize)
+	addUint(propRawValueSize, props.RawValueSize)
+	addUint(propSmallestSeq, props.SmallestSeq)
+	addUint(propTopLevelIndexSize, props.TopLevelIndexSize)
+}
+
+func (props *TableProperties) DecodeFrom(propsBlock *block.Block) {
+	it := propsBlock.NewIterator(common.BytewiseComparator)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		item := it.InternalKey()
+		value, _ := binary.Uvarint(item.UserValue)
+		switch string(item.UserKey) {
+		case propComparator:
+			props.ComparatorName = string(item.UserValue)
+		case propCompression:
+			props.CompressionName = string(item.UserValue)
+		case propCreationTime:
+			props.CreationTime = value
+		case propDataSize:
+			props.DataSize = value
+		case propGlobalSeq:
+			if len(item.UserValue) == 8 {
+				props.GlobalSeq = binary.LittleEndian.Uint64(item.UserValue)
+			}
+		case propExternalVersion:
+			props.ExternalVersion = value
+		case propFilterPolicy:
+			props.FilterPolicyName = string(item.UserValue)
+		case propIndexSize:
+			props.IndexSize = value
+		case propIndexType:
+			props.IndexType = value
+		case propLargestSeq:
+			props.LargestSeq = value
+		case propNumDataBlocks:
+			props.NumDataBlocks = value
+		case propNumDeletions:
+			props.NumDeletions = value
+		case propNumEntries:
+			props.NumEntries = value
+		case propNumIndexPartitions:
+			props.NumIndexPartitions = value
+		case propRawKeySize:
+			props.RawKeySize = value
+		case propRawValueSize:
+			props.RawValueSize = value
+		case propSmallestSeq:
+			props.SmallestSeq = value
+		case propTopLevelIndexSize:
+			props.TopLevelIndexSize = value
+		}
+	}
+}
+
+// Returns the offset of the global sequence number value inside an encoded
+// properties block, or -1 if the block does not hold one.
+func globalSeqOffset(p []byte) int {
+	if len(p) < 4 {
+		return -1
+	}
+	data := p[:len(p)-4]
+	offset := 0
+	for offset < len(data) {
+		var item common.InternalKey
+		n := item.DecodeFromBytes(data[offset:])
+		if n == 0 {
+			return -1
+		}
+		if string(item.UserKey) == propGlobalSeq && len(item.UserValue) == 8 {
+			// the value is the last field of the entry
+			return offset + n - 8
+		}
+		offset += n
+	}
+	return -1
+}
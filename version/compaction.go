@@ -1,22 +1,85 @@
 // Created on 2021/3/25 by @zzl
 package version
 
-import log "github.com/sirupsen/logrus"
+import (
+	"asukadb/common"
+	"asukadb/options"
+	log "github.com/sirupsen/logrus"
+	"sort"
+)
 
 type Compaction struct {
 	level  int
-	// Each compaction reads inputs from "level" and "level+1"
+	inputVersion *Version
+	// Each compaction reads inputs from "level" and "outputLevel", which
+	// is "level+1" unless the compaction is universal
+	outputLevel int
 	inputs [2][]*FileMetaData  // The two sets of inputs
+	// Picked to rewrite a table written in an older format
+	upgradeFormat bool
+	// Requested by CompactRange, the inputs are always rewritten
+	manual bool
+
+	// Bytes of the inputs which were rewritten and of the outputs
+	bytesRead    uint64
+	bytesWritten uint64
+
+	// Sequence numbers of the live snapshots in increasing order
+	snapshots []uint64
+
+	// Files overlapping the compaction in level+2
+	// (parent == level+1; grandparent == level+2)
+	grandparents               []*FileMetaData
+	maxGrandparentOverlapBytes uint64
+}
+
+// The part of a compaction covering the user keys in [start,end), a nil
+// start or end means unbounded.  The subcompactions of a compaction cover
+// disjoint ranges and run on their own goroutines.
+type subcompaction struct {
+	c          *Compaction
+	start, end []byte
+	outputs    []*FileMetaData
+	// Bytes of the outputs
+	bytesWritten uint64
+	err          error
+
+	// State used to check for number of overlapping grandparent files
+	grandparentIndex int    // Index in grandparents
+	seenKey          bool   // Some output key has been seen
+	overlappedBytes  uint64 // Bytes of overlap between current output and grandparent files
+
+	// State for implementing isBaseLevelForKey
+
+	// levelPtrs holds indices into inputVersion.files: our state is that
+	// we are positioned at one of the file ranges for each higher level
+	// than the ones involved in this compaction (i.e. for all L > outputLevel).
+	levelPtrs [common.NumLevels]int
+}
+
+// Work done by compactions
+type CompactionStats struct {
+	Compactions  int // Trivial moves included
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+func (stats *CompactionStats) add(c *Compaction) {
+	stats.Compactions++
+	stats.BytesRead += c.bytesRead
+	stats.BytesWritten += c.bytesWritten
 }
 
 // Is this a trivial compaction that can be implemented by just
 // moving a single input file to the next level (no merging or splitting)
 func (c *Compaction) isTrivialMove() bool {
-	return len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0
+	// Moving would keep the table in its old format, or the entries a
+	// manual compaction is meant to drop
+	return len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 && !c.upgradeFormat && !c.manual
 }
 
 func (c *Compaction) Log() {
-	log.Infof("Compaction, level:%d", c.level)
+	log.Infof("Compaction, level:%d, output level:%d", c.level, c.outputLevel)
 	for i := 0; i < len(c.inputs[0]); i++ {
 		log.Infof("inputs[0]: %d", c.inputs[0][i].number)
 	}
@@ -24,3 +87,131 @@ func (c *Compaction) Log() {
 		log.Infof("inputs[1]: %d", c.inputs[1][i].number)
 	}
 }
+
+// Splits the compaction into at most n subcompactions at the smallest
+// keys of its input files, so that each of them reads about as many files.
+func (c *Compaction) split(n int) []*subcompaction {
+	if c.outputLevel == 0 {
+		// The output is a single run of level 0
+		n = 1
+	}
+	ucmp := c.inputVersion.icmp.UserComparator
+	var bounds [][]byte
+	for which := 0; which < 2; which++ {
+		for i := 0; i < len(c.inputs[which]); i++ {
+			bounds = append(bounds, c.inputs[which][i].smallest.UserKey)
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return ucmp.Compare(bounds[i], bounds[j]) < 0 })
+	var keys [][]byte
+	for i := 0; i < len(bounds); i++ {
+		if i == 0 || ucmp.Compare(bounds[i], bounds[i-1]) != 0 {
+			keys = append(keys, bounds[i])
+		}
+	}
+	if n > len(keys) {
+		n = len(keys)
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	subs := make([]*subcompaction, n)
+	for i := 0; i < n; i++ {
+		subs[i] = &subcompaction{c: c}
+		if i > 0 {
+			// keys[0] is where the first subcompaction starts anyway
+			subs[i].start = keys[i*len(keys)/n]
+			subs[i-1].end = subs[i].start
+		}
+	}
+	return subs
+}
+
+// Returns true if the user key is past the end of the subcompaction.
+func (sub *subcompaction) pastEnd(userKey []byte) bool {
+	return sub.end != nil && sub.c.inputVersion.icmp.UserComparator.Compare(userKey, sub.end) >= 0
+}
+
+// Returns true if the file holds keys of the subcompaction.
+func (sub *subcompaction) overlaps(f *FileMetaData) bool {
+	ucmp := sub.c.inputVersion.icmp.UserComparator
+	if sub.start != nil && ucmp.Compare(f.largest.UserKey, sub.start) < 0 {
+		return false
+	}
+	return !sub.pastEnd(f.smallest.UserKey)
+}
+
+// Returns true iff we should stop building the current output before
+// processing key, which happens once the output overlaps too many bytes
+// of grandparent files.
+func (sub *subcompaction) shouldStopBefore(key *common.InternalKey) bool {
+	// Scan to find earliest grandparent file that contains key.
+	c := sub.c
+	icmp := c.inputVersion.icmp
+	for sub.grandparentIndex < len(c.grandparents) && icmp.Compare(key, c.grandparents[sub.grandparentIndex].largest) > 0 {
+		if sub.seenKey {
+			sub.overlappedBytes += c.grandparents[sub.grandparentIndex].fileSize
+		}
+		sub.grandparentIndex++
+	}
+	sub.seenKey = true
+
+	if sub.overlappedBytes > c.maxGrandparentOverlapBytes {
+		// Too much overlap for current output; start new output
+		sub.overlappedBytes = 0
+		return true
+	}
+	return false
+}
+
+// Returns the index of the first snapshot which sees an entry of sequence
+// number seq, or len(c.snapshots) if only the current state does.  All
+// snapshots of a stripe see the same entries.
+func (c *Compaction) snapshotStripe(seq uint64) int {
+	return sort.Search(len(c.snapshots), func(i int) bool { return c.snapshots[i] >= seq })
+}
+
+// Returns true if the information we have available guarantees that
+// the compaction is producing data in "outputLevel" for which no data
+// exists in levels greater than "outputLevel".  The keys passed must be
+// increasing.
+func (sub *subcompaction) isBaseLevelForKey(userKey []byte) bool {
+	// Maybe use binary search to find right entry instead of linear search?
+	c := sub.c
+	if c.outputLevel == 0 {
+		// Older runs of level 0 are left out of the compaction
+		return false
+	}
+	ucmp := c.inputVersion.icmp.UserComparator
+	for level := c.outputLevel + 1; level < common.NumLevels; level++ {
+		files := c.inputVersion.files[level]
+		for sub.levelPtrs[level] < len(files) {
+			f := files[sub.levelPtrs[level]]
+			if ucmp.Compare(userKey, f.largest.UserKey) <= 0 {
+				// We've advanced far enough
+				if ucmp.Compare(userKey, f.smallest.UserKey) >= 0 {
+					// Key falls in this file's range, so definitely not base level
+					return false
+				}
+				break
+			}
+			sub.levelPtrs[level]++
+		}
+	}
+	return true
+}
+
+// Passes an entry which no snapshot sees to the compaction filter.  Returns
+// the entry to write in its place, key itself unless the filter removed it
+// or changed its value.
+func filterEntry(filter options.CompactionFilter, level int, manual bool, key *common.InternalKey) *common.InternalKey {
+	decision, value := filter.Filter(level, manual, key.UserKey, key.UserValue)
+	switch decision {
+	case options.CompactionFilterRemove:
+		return &common.InternalKey{Seq: key.Seq, Type: common.TypeDeletion, UserKey: key.UserKey}
+	case options.CompactionFilterChangeValue:
+		return &common.InternalKey{Seq: key.Seq, Type: common.TypeValue, UserKey: key.UserKey, UserValue: value}
+	}
+	return key
+}
@@ -3,35 +3,83 @@ package version
 
 import (
 	"asukadb/common"
+	"asukadb/sstable"
 	"encoding/binary"
 	"io"
+	"sync/atomic"
 )
 
 type FileMetaData struct {
-	allowSeeks uint64
+	allowSeeks int64 // Seeks allowed until compaction, accessed atomically
 	number     uint64
 	fileSize   uint64  // File size in bytes
 	smallest   *common.InternalKey  // Smallest internal key served by table
 	largest    *common.InternalKey  // Largest internal key served by table
+	formatVersion uint32 // Format the table was written in
 }
 
 func (meta *FileMetaData) EncodeTo(w io.Writer) error {
-	binary.Write(w, binary.LittleEndian, meta.allowSeeks)
+	binary.Write(w, binary.LittleEndian, atomic.LoadInt64(&meta.allowSeeks))
 	binary.Write(w, binary.LittleEndian, meta.fileSize)
 	binary.Write(w, binary.LittleEndian, meta.number)
 	meta.smallest.EncodeTo(w)
 	meta.largest.EncodeTo(w)
+	binary.Write(w, binary.LittleEndian, meta.formatVersion)
 	return nil
 }
 
-func (meta *FileMetaData) DecodeFrom(r io.Reader) error {
-	binary.Read(r, binary.LittleEndian, &meta.allowSeeks)
-	binary.Read(r, binary.LittleEndian, &meta.fileSize)
-	binary.Read(r, binary.LittleEndian, &meta.number)
+// Decodes a record of a manifest written in manifestVersion.
+func (meta *FileMetaData) DecodeFrom(r io.Reader, manifestVersion uint32) error {
+	if binary.Read(r, binary.LittleEndian, &meta.allowSeeks) != nil ||
+		binary.Read(r, binary.LittleEndian, &meta.fileSize) != nil ||
+		binary.Read(r, binary.LittleEndian, &meta.number) != nil {
+		return common.ErrManifestCorrupted
+	}
 	meta.smallest = new(common.InternalKey)
-	meta.smallest.DecodeFrom(r)
+	if err := meta.smallest.DecodeFrom(r); err != nil {
+		return err
+	}
 	meta.largest = new(common.InternalKey)
-	meta.largest.DecodeFrom(r)
+	if err := meta.largest.DecodeFrom(r); err != nil {
+		return err
+	}
+	if manifestVersion >= manifestVersion1 {
+		if binary.Read(r, binary.LittleEndian, &meta.formatVersion) != nil {
+			return common.ErrManifestCorrupted
+		}
+	} else {
+		// Tables listed by a legacy manifest predate the versioned footer
+		meta.formatVersion = sstable.LegacyFormatVersion
+	}
+	// older versions saved an allowance which never runs out
+	if allowSeeks := allowSeeksForSize(meta.fileSize); meta.allowSeeks > allowSeeks {
+		meta.allowSeeks = allowSeeks
+	}
 	return nil
 }
 
+// We arrange to automatically compact a file after a certain number of
+// seeks.  Let's assume:
+//   (1) One seek costs 10ms
+//   (2) Writing or reading 1MB costs 10ms (100MB/s)
+//   (3) A compaction of 1MB does 25MB of IO:
+//         1MB read from this level
+//         10-12MB read from next level (boundaries may be misaligned)
+//         10-12MB written to next level
+// This implies that 25 seeks cost the same as the compaction of 1MB of
+// data.  I.e., one seek costs approximately the same as the compaction of
+// 40KB of data.  We are a little conservative and allow approximately one
+// seek for every 16KB of data before triggering a compaction.
+func allowSeeksForSize(fileSize uint64) int64 {
+	allowSeeks := int64(fileSize / 16384)
+	if allowSeeks < 100 {
+		allowSeeks = 100
+	}
+	return allowSeeks
+}
+
+// Returns a copy of the key without the value, the boundary keys of a file
+// must not reference the blocks or memtable they were read from.
+func copyKey(key *common.InternalKey) *common.InternalKey {
+	return common.NewInternalKey(key.Seq, key.Type, key.UserKey, nil)
+}
@@ -7,12 +7,14 @@ import (
 )
 
 type MergingIterator struct {
+	icmp    common.InternalKeyComparator
 	list    []*sstable.Iterator
 	current *sstable.Iterator
 }
 
-func NewMergingIterator(list []*sstable.Iterator) *MergingIterator {
+func NewMergingIterator(icmp common.InternalKeyComparator, list []*sstable.Iterator) *MergingIterator {
 	var iter MergingIterator
+	iter.icmp = icmp
 	iter.list = list
 	return &iter
 }
@@ -44,13 +46,40 @@ func (it *MergingIterator) SeekToFirst() {
 	it.findSmallest()
 }
 
+// Position at the first entry with a user key >= target.
+func (it *MergingIterator) Seek(target []byte) {
+	for i := 0; i < len(it.list); i++ {
+		it.list[i].Seek(target)
+	}
+	it.findSmallest()
+}
+
+// Returns the first error of the child iterators, the entries of that
+// child may then be missing from the merged ones.
+func (it *MergingIterator) Err() error {
+	for i := 0; i < len(it.list); i++ {
+		if err := it.list[i].Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Closes all child iterators.
+func (it *MergingIterator) Close() {
+	for i := 0; i < len(it.list); i++ {
+		it.list[i].Close()
+	}
+	it.current = nil
+}
+
 func (it *MergingIterator) findSmallest() {
 	var smallest *sstable.Iterator = nil
 	for i := 0; i < len(it.list); i++ {
 		if it.list[i].Valid() {
 			if smallest == nil {
 				smallest = it.list[i]
-			} else if common.InternalKeyComparator(smallest.InternalKey(), it.list[i].InternalKey()) > 0 {
+			} else if it.icmp.Compare(smallest.InternalKey(), it.list[i].InternalKey()) > 0 {
 				smallest = it.list[i]
 			}
 		}
@@ -4,55 +4,170 @@ package version
 import (
 	"asukadb/common"
 	"asukadb/lru"
+	"asukadb/options"
 	"asukadb/sstable"
+	"encoding/binary"
 	"sync"
+	"sync/atomic"
 )
 
+// Shards of the table cache hold at least this many tables
+const minTableCacheShardSize = 64
+
+const maxTableCacheShardBits = 4
+
+// TableCache keeps a bounded number of tables open.  Iterators pin their
+// table, a table which is evicted or erased is closed once the last
+// iterator using it is closed.
 type TableCache struct {
-	mu sync.Mutex
-	cache *lru.Cache
+	mu     sync.Mutex
+	cache  lru.Cache
 	dbName string
+	opts   *options.Options
+	// Shared by all tables, nil if the block cache is disabled
+	blockCache *sstable.BlockCache
+	// Number of tables which are open, pinned tables evicted from the
+	// cache included
+	openFiles int64
 }
 
-func NewTableCache(dbName string) *TableCache {
+func NewTableCache(dbName string, opts *options.Options) *TableCache {
 	var tableCache TableCache
-	tableCache.cache, _ = lru.NewCache(common.MaxOpenFiles - common.NumNonTableCacheFiles, nil)
+	capacity := int64(opts.MaxOpenFiles - common.NumNonTableCacheFiles)
+	if capacity < 1 {
+		capacity = 1
+	}
+	numShardBits := 0
+	for numShardBits < maxTableCacheShardBits && capacity>>uint(numShardBits+1) >= minTableCacheShardSize {
+		numShardBits++
+	}
+	tableCache.cache = lru.New(lru.Config{
+		Policy:       opts.TableCachePolicy,
+		Capacity:     capacity,
+		NumShardBits: numShardBits,
+	}, tableCache.closeTable)
 	tableCache.dbName = dbName
+	tableCache.opts = opts
+	if opts.BlockCacheCapacity > 0 || opts.BlockCache != nil {
+		tableCache.blockCache = sstable.NewBlockCache(opts)
+	}
 	return &tableCache
 }
 
-func (tableCache *TableCache) NewSSTIterator(fileNum uint64) *sstable.Iterator {
-	table, err := tableCache.getTable(fileNum)
+// Runs once the table has left the cache and is no longer pinned.
+func (tableCache *TableCache) closeTable(key string, value interface{}) {
+	value.(*sstable.SsTable).Close()
+	atomic.AddInt64(&tableCache.openFiles, -1)
+}
+
+// Returns an iterator over the table, the table stays open until the
+// iterator is closed.
+func (tableCache *TableCache) NewSSTIterator(fileNum uint64, ro *options.ReadOptions) (*sstable.Iterator, error) {
+	h, err := tableCache.findTable(fileNum)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	return table.NewIterator()
+	it := h.Value().(*sstable.SsTable).NewIterator(ro)
+	it.RegisterCleanup(func() {
+		tableCache.cache.Release(h)
+	})
+	return it, nil
 }
 
-func (tableCache *TableCache) Get(fileNum uint64, key []byte) ([]byte, error) {
-	table, err := tableCache.getTable(fileNum)
+func (tableCache *TableCache) Get(fileNum uint64, key []byte, ro *options.ReadOptions) ([]byte, error) {
+	h, err := tableCache.findTable(fileNum)
 	if err != nil {
 		return nil, err
 	}
-	return table.Get(key)
+	defer tableCache.cache.Release(h)
+	return h.Value().(*sstable.SsTable).Get(key, ro)
+}
+
+// Returns the counters of the cache of open tables.
+func (tableCache *TableCache) Stats() lru.Stats {
+	return tableCache.cache.Stats()
+}
+
+// Returns the number of open table files.
+func (tableCache *TableCache) NumOpenFiles() int64 {
+	return atomic.LoadInt64(&tableCache.openFiles)
+}
+
+// Returns the counters of the block cache, or zero counters if it
+// is disabled.
+func (tableCache *TableCache) BlockCacheStats() sstable.BlockCacheStats {
+	if tableCache.blockCache == nil {
+		return sstable.BlockCacheStats{}
+	}
+	return tableCache.blockCache.Stats()
+}
+
+// Changes the capacity of the block cache, it has no effect if the block
+// cache is disabled.
+func (tableCache *TableCache) SetBlockCacheCapacity(capacity int64) {
+	if tableCache.blockCache != nil {
+		tableCache.blockCache.SetCapacity(capacity)
+	}
+}
+
+func (tableCache *TableCache) GetProperties(fileNum uint64) (*sstable.TableProperties, error) {
+	h, err := tableCache.findTable(fileNum)
+	if err != nil {
+		return nil, err
+	}
+	defer tableCache.cache.Release(h)
+	return h.Value().(*sstable.SsTable).Properties(), nil
+}
+
+func (tableCache *TableCache) FormatVersion(fileNum uint64) (uint32, error) {
+	h, err := tableCache.findTable(fileNum)
+	if err != nil {
+		return 0, err
+	}
+	defer tableCache.cache.Release(h)
+	return h.Value().(*sstable.SsTable).FormatVersion(), nil
 }
 
 func (tableCache *TableCache) Evict(fileNum uint64) {
 	tableCache.mu.Lock()
 	defer tableCache.mu.Unlock()
-	tableCache.cache.Remove(fileNum)
+	tableCache.cache.Erase(tableCacheKey(fileNum))
 }
 
-func (tableCache *TableCache) getTable(fileNum uint64) (*sstable.SsTable, error) {
+// Closes all cached tables.
+func (tableCache *TableCache) Close() {
 	tableCache.mu.Lock()
 	defer tableCache.mu.Unlock()
+	tableCache.cache.Purge()
+}
 
-	table, ok := tableCache.cache.Get(fileNum)
-	if ok {
-		return table.(*sstable.SsTable), nil
-	} else {
-		newTable, err := sstable.Open(common.GetTableFileName(tableCache.dbName, fileNum))
-		tableCache.cache.Add(fileNum, newTable)
-		return newTable, err
+// Returns a handle pinning the table, the caller must release it.  A
+// table which fails to open is not cached, the next lookup retries.  The
+// table is opened without holding mu, so that lookups of other tables
+// don't wait for the I/O.
+func (tableCache *TableCache) findTable(fileNum uint64) (*lru.Handle, error) {
+	key := tableCacheKey(fileNum)
+	if h := tableCache.cache.Lookup(key); h != nil {
+		return h, nil
 	}
+	table, err := sstable.Open(common.GetTableFileName(tableCache.dbName, fileNum), tableCache.opts, tableCache.blockCache)
+	if err != nil {
+		return nil, err
+	}
+
+	tableCache.mu.Lock()
+	defer tableCache.mu.Unlock()
+	if h := tableCache.cache.Lookup(key); h != nil {
+		// Another lookup opened the table first, keep its copy
+		table.Close()
+		return h, nil
+	}
+	atomic.AddInt64(&tableCache.openFiles, 1)
+	return tableCache.cache.Insert(key, table, 1), nil
+}
+
+func tableCacheKey(fileNum uint64) string {
+	var p [8]byte
+	binary.LittleEndian.PutUint64(p[:], fileNum)
+	return string(p[:])
 }
@@ -0,0 +1,143 @@
+// Created on 2021/5/6 by @zzl
+package version
+
+import (
+	"asukadb/common"
+	"asukadb/sstable"
+	log "github.com/sirupsen/logrus"
+	"sort"
+)
+
+// With universal compaction each file of level 0 is a sorted run, and
+// the last level holds the oldest run.  Runs are merged from the newest
+// one, so that the merged run is still newer than the runs left out.
+
+type sortedRun struct {
+	level int
+	files []*FileMetaData
+	size  uint64
+}
+
+// Returns the sorted runs from the newest.
+func (v *Version) sortedRuns() []sortedRun {
+	files := append([]*FileMetaData(nil), v.files[0]...)
+	sort.Slice(files, func(i, j int) bool { return files[i].number > files[j].number })
+	var runs []sortedRun
+	for _, f := range files {
+		runs = append(runs, sortedRun{level: 0, files: []*FileMetaData{f}, size: f.fileSize})
+	}
+	last := common.NumLevels - 1
+	if len(v.files[last]) > 0 {
+		runs = append(runs, sortedRun{level: last, files: v.files[last], size: totalFileSize(v.files[last])})
+	}
+	return runs
+}
+
+// Picks the runs to merge once there are too many of them, or returns nil.
+func (v *Version) pickUniversalCompaction() *Compaction {
+	opts := &v.tableCache.opts.Universal
+	runs := v.sortedRuns()
+	if len(runs) < 2 || len(runs) < opts.NumRunsCompactionTrigger {
+		return nil
+	}
+
+	// Merge all runs if the newer ones take too much space compared to
+	// the oldest one, most of it is likely to be obsolete
+	var newerSize uint64
+	for i := 0; i < len(runs)-1; i++ {
+		newerSize += runs[i].size
+	}
+	oldestSize := runs[len(runs)-1].size
+	if newerSize*100 > uint64(opts.MaxSizeAmplificationPercent)*oldestSize {
+		log.Infof("Universal: size amplification %d/%d bytes, merging all %d runs", newerSize, oldestSize, len(runs))
+		return v.universalCompaction(runs, len(runs))
+	}
+
+	// Merge the newest runs while the next one is not much larger than
+	// the runs merged so far
+	n := 1
+	size := runs[0].size
+	for n < len(runs) && n < opts.MaxMergeWidth {
+		if size*uint64(100+opts.SizeRatio)/100 < runs[n].size {
+			break
+		}
+		size += runs[n].size
+		n++
+	}
+	if n >= opts.MinMergeWidth {
+		log.Infof("Universal: size ratio, merging %d of %d runs", n, len(runs))
+		return v.universalCompaction(runs, n)
+	}
+
+	// Merge the newest runs to get back under the trigger
+	n = len(runs) - opts.NumRunsCompactionTrigger + 2
+	if n < 2 {
+		n = 2
+	}
+	if n > len(runs) {
+		n = len(runs)
+	}
+	log.Infof("Universal: %d runs, merging %d of them", len(runs), n)
+	return v.universalCompaction(runs, n)
+}
+
+// Returns the compaction rewriting the newest run holding a table written
+// in an older format, or nil if there is none.  A run of level 0 is merged
+// with the newer runs, so that the output is still newer than the runs
+// left out.
+func (v *Version) pickUniversalUpgrade() *Compaction {
+	runs := v.sortedRuns()
+	for i, run := range runs {
+		for _, f := range run.files {
+			if f.formatVersion >= sstable.CurrentFormatVersion {
+				continue
+			}
+			if run.level != 0 {
+				return v.upgradeLastLevelFile(f)
+			}
+			c := v.universalCompaction(runs, i+1)
+			c.upgradeFormat = true
+			return c
+		}
+	}
+	return nil
+}
+
+// Returns the compaction merging the n newest runs.  The merged run goes
+// to the last level if it includes the oldest run, else to level 0.
+func (v *Version) universalCompaction(runs []sortedRun, n int) *Compaction {
+	c := new(Compaction)
+	c.inputVersion = v
+	c.level = 0
+	c.outputLevel = 0
+	if n == len(runs) {
+		c.outputLevel = common.NumLevels - 1
+	}
+	for i := 0; i < n; i++ {
+		if runs[i].level == 0 {
+			c.inputs[0] = append(c.inputs[0], runs[i].files...)
+		} else {
+			c.inputs[1] = runs[i].files
+		}
+	}
+	return c
+}
+
+// Merges all runs into the last level, only level 0 holds runs to merge.
+func (v *Version) compactAllRuns(level int, snapshots []uint64, stats *CompactionStats) error {
+	if level != 0 {
+		return nil
+	}
+	runs := v.sortedRuns()
+	if len(runs) == 0 {
+		return nil
+	}
+	c := v.universalCompaction(runs, len(runs))
+	c.snapshots = snapshots
+	c.manual = true
+	if err := v.runCompaction(c); err != nil {
+		return err
+	}
+	stats.add(c)
+	return nil
+}
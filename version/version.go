@@ -3,42 +3,78 @@ package version
 
 import (
 	"asukadb/common"
+	"asukadb/lru"
 	"asukadb/memtable"
+	"asukadb/options"
+	"asukadb/ratelimit"
 	"asukadb/sstable"
 	"encoding/binary"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"os"
 	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Longest comparator name accepted when loading a version
+const maxComparatorNameLength = 1 << 10
+
+// A manifest starts with manifestMagic and its version, the layout of the
+// first databases started with the next file number instead.
+const manifestMagic uint64 = 0x4d414e4946455354
+
+const (
+	// No magic, no comparator name and no table format versions
+	legacyManifestVersion = 0
+	// The comparator name, and the format version of each table
+	manifestVersion1       = 1
+	currentManifestVersion = manifestVersion1
 )
 
 type Version struct {
 	tableCache     *TableCache
+	icmp           common.InternalKeyComparator
 	nextFileNumber uint64
 	seq            uint64
 	files          [common.NumLevels][]*FileMetaData
 	// Per-level key at which the next compaction at that level should start.
 	// Either an empty string, or a valid InternalKey.
 	compactPointer [common.NumLevels]*common.InternalKey
+
+	// Next file to compact based on seek stats.
+	fileToCompact      *FileMetaData
+	fileToCompactLevel int
+}
+
+// Records the file which was probed in vain by a Get, see UpdateStats.
+type GetStats struct {
+	seekFile      *FileMetaData
+	seekFileLevel int
 }
 
-func New(dbName string) *Version {
+func New(dbName string, opts *options.Options) *Version {
 	var v Version
-	v.tableCache = NewTableCache(dbName)
+	v.tableCache = NewTableCache(dbName, opts)
+	v.icmp = common.NewInternalKeyComparator(opts.Comparator)
 	v.nextFileNumber = 1
 	return &v
 }
 
-func LoadFromLocal(dbName string, num uint64) (*Version, error) {
+func LoadFromLocal(dbName string, num uint64, opts *options.Options) (*Version, error) {
 	fileName := common.GetDescriptorFileName(dbName, num)
 	file, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-	v := New(dbName)
+	v := New(dbName, opts)
 	err = v.DecodeFrom(file)
-	return v, err
+	if err != nil {
+		v.Close()
+		return nil, err
+	}
+	return v, nil
 }
 
 func (v *Version) Save() (uint64, error) {
@@ -58,8 +94,11 @@ func (v *Version) Copy() *Version {
 	var c Version
 
 	c.tableCache = v.tableCache
+	c.icmp = v.icmp
 	c.nextFileNumber = v.nextFileNumber
 	c.seq = v.seq
+	c.fileToCompact = v.fileToCompact
+	c.fileToCompactLevel = v.fileToCompactLevel
 	for level := 0; level < common.NumLevels; level++ {
 		c.files[level] = make([]*FileMetaData, len(v.files[level]))
 		copy(c.files[level], v.files[level])
@@ -67,21 +106,40 @@ func (v *Version) Copy() *Version {
 	return &c
 }
 
+// Closes the table cache shared by this version and all its copies.
+func (v *Version) Close() {
+	v.tableCache.Close()
+}
+
 func (v *Version) NextSeq() uint64 {
 	v.seq++
 	return v.seq
 }
 
+// Returns the sequence number of the last write.
+func (v *Version) LastSequence() uint64 {
+	return v.seq
+}
+
+func (v *Version) SetLastSequence(seq uint64) {
+	v.seq = seq
+}
+
 func (v *Version) NumLevelFiles(level int) int {
 	return len(v.files[level])
 }
 
-func (v *Version) Get(key []byte) ([]byte, error) {
+// Looks up the key in the tables, a nil ro means the default read options.
+// If stats is not nil, it records the first file which had to be probed
+// before the one holding the key, to be charged by UpdateStats.
+func (v *Version) Get(key []byte, ro *options.ReadOptions, stats *GetStats) ([]byte, error) {
 	// We can search level-by-level since entries never hop across
 	// levels.  Therefore we are guaranteed that if we find data
 	// in a smaller level, later levels are irrelevant.
 	var tmp []*FileMetaData
 	var tmp2 [1]*FileMetaData
+	var lastFileRead *FileMetaData
+	lastFileReadLevel := -1
 
 	var files []*FileMetaData
 
@@ -97,7 +155,7 @@ func (v *Version) Get(key []byte) ([]byte, error) {
 			// overlap user_key and process them in order from newest to oldest.
 			for i := 0; i < numFiles; i++ {
 				f := v.files[level][i]
-				if common.UserKeyComparator(key, f.smallest.UserKey) >= 0 && common.UserKeyComparator(key, f.largest.UserKey) <= 0 {
+				if v.icmp.UserComparator.Compare(key, f.smallest.UserKey) >= 0 && v.icmp.UserComparator.Compare(key, f.largest.UserKey) <= 0 {
 					tmp = append(tmp, f)
 				}
 			}
@@ -115,7 +173,7 @@ func (v *Version) Get(key []byte) ([]byte, error) {
 				numFiles = 0
 			} else {
 				tmp2[0] = v.files[level][index]
-				if common.UserKeyComparator(key, tmp2[0].smallest.UserKey) < 0 {
+				if v.icmp.UserComparator.Compare(key, tmp2[0].smallest.UserKey) < 0 {
 					// All of "tmp2" is past any data for user_key
 					files = nil
 					numFiles = 0
@@ -127,7 +185,15 @@ func (v *Version) Get(key []byte) ([]byte, error) {
 		}
 		for i := 0; i < numFiles; i++ {
 			f := files[i]
-			value, err := v.tableCache.Get(f.number, key)
+			if stats != nil && lastFileRead != nil && stats.seekFile == nil {
+				// We have had more than one seek for this read.  Charge the 1st file.
+				stats.seekFile = lastFileRead
+				stats.seekFileLevel = lastFileReadLevel
+			}
+			lastFileRead = f
+			lastFileReadLevel = level
+
+			value, err := v.tableCache.Get(f.number, key, ro)
 			if err != common.ErrNotFound {
 				return value, err
 			}
@@ -136,13 +202,61 @@ func (v *Version) Get(key []byte) ([]byte, error) {
 	return nil, common.ErrNotFound
 }
 
+// Charges a seek to the file recorded by Get.  Returns true if the file
+// ran out of seeks and a compaction should be scheduled.
+// REQUIRES: the caller serializes calls on the version
+func (v *Version) UpdateStats(stats *GetStats) bool {
+	f := stats.seekFile
+	if f == nil {
+		return false
+	}
+	if atomic.AddInt64(&f.allowSeeks, -1) <= 0 && v.fileToCompact == nil {
+		v.fileToCompact = f
+		v.fileToCompactLevel = stats.seekFileLevel
+		return true
+	}
+	return false
+}
+
+func (v *Version) BlockCacheStats() sstable.BlockCacheStats {
+	return v.tableCache.BlockCacheStats()
+}
+
+func (v *Version) SetBlockCacheCapacity(capacity int64) {
+	v.tableCache.SetBlockCacheCapacity(capacity)
+}
+
+func (v *Version) TableCacheStats() lru.Stats {
+	return v.tableCache.Stats()
+}
+
+func (v *Version) NumOpenTableFiles() int64 {
+	return v.tableCache.NumOpenFiles()
+}
+
+// Returns the properties of every live table, keyed by table file name.
+func (v *Version) GetPropertiesOfAllTables() (map[string]*sstable.TableProperties, error) {
+	result := make(map[string]*sstable.TableProperties)
+	for level := 0; level < common.NumLevels; level++ {
+		for i := 0; i < len(v.files[level]); i++ {
+			number := v.files[level][i].number
+			props, err := v.tableCache.GetProperties(number)
+			if err != nil {
+				return nil, err
+			}
+			result[common.GetTableFileName(v.tableCache.dbName, number)] = props
+		}
+	}
+	return result, nil
+}
+
 func (v *Version) findFile(files []*FileMetaData, key []byte) int {
 	left := 0
 	right := len(files)
 	for left < right {
 		mid := (left + right) / 2
 		f := files[mid]
-		if common.UserKeyComparator(f.largest.UserKey, key) < 0 {
+		if v.icmp.UserComparator.Compare(f.largest.UserKey, key) < 0 {
 			left = mid + 1
 		} else {
 			right = mid
@@ -160,6 +274,11 @@ func (v *Version) Log() {
 }
 
 func (v *Version) EncodeTo(w io.Writer) error {
+	binary.Write(w, binary.LittleEndian, manifestMagic)
+	binary.Write(w, binary.LittleEndian, uint32(currentManifestVersion))
+	comparatorName := v.icmp.UserComparator.Name()
+	binary.Write(w, binary.LittleEndian, int32(len(comparatorName)))
+	binary.Write(w, binary.LittleEndian, []byte(comparatorName))
 	binary.Write(w, binary.LittleEndian, v.nextFileNumber)
 	binary.Write(w, binary.LittleEndian, v.seq)
 	for level := 0; level < common.NumLevels; level++ {
@@ -173,16 +292,50 @@ func (v *Version) EncodeTo(w io.Writer) error {
 	return nil
 }
 
+// Fails with common.ErrComparatorMismatch if the version was saved by a
+// database using another comparator, and with common.ErrManifestCorrupted
+// if it can't be parsed.  Manifests without a version were written before
+// comparators could be chosen, they use the bytewise comparator.
 func (v *Version) DecodeFrom(r io.Reader) error {
-	binary.Read(r, binary.LittleEndian, &v.nextFileNumber)
-	binary.Read(r, binary.LittleEndian, &v.seq)
+	var magic uint64
+	if binary.Read(r, binary.LittleEndian, &magic) != nil {
+		return common.ErrManifestCorrupted
+	}
+	manifestVersion := uint32(legacyManifestVersion)
+	comparatorName := common.BytewiseComparator.Name()
+	if magic == manifestMagic {
+		var nameLen int32
+		if binary.Read(r, binary.LittleEndian, &manifestVersion) != nil || manifestVersion > currentManifestVersion ||
+			binary.Read(r, binary.LittleEndian, &nameLen) != nil || nameLen < 0 || nameLen > maxComparatorNameLength {
+			return common.ErrManifestCorrupted
+		}
+		name := make([]byte, nameLen)
+		if binary.Read(r, binary.LittleEndian, name) != nil ||
+			binary.Read(r, binary.LittleEndian, &v.nextFileNumber) != nil {
+			return common.ErrManifestCorrupted
+		}
+		comparatorName = string(name)
+	} else {
+		// The legacy layout starts with the next file number
+		v.nextFileNumber = magic
+	}
+	if comparatorName != v.icmp.UserComparator.Name() {
+		return common.ErrComparatorMismatch
+	}
+	if binary.Read(r, binary.LittleEndian, &v.seq) != nil {
+		return common.ErrManifestCorrupted
+	}
 	var numFiles int32
 	for level := 0; level < common.NumLevels; level++ {
-		binary.Read(r, binary.LittleEndian, &numFiles)
+		if binary.Read(r, binary.LittleEndian, &numFiles) != nil || numFiles < 0 {
+			return common.ErrManifestCorrupted
+		}
 		v.files[level] = make([]*FileMetaData, numFiles)
 		for i := 0; i < int(numFiles); i++ {
 			var meta FileMetaData
-			meta.DecodeFrom(r)
+			if err := meta.DecodeFrom(r, manifestVersion); err != nil {
+				return err
+			}
 			v.files[level][i] = &meta
 		}
 	}
@@ -191,99 +344,318 @@ func (v *Version) DecodeFrom(r io.Reader) error {
 
 // Compaction related
 
-func (v *Version) WriteLevel0Table(imm *memtable.MemTable) {
+// Writes the memtable to a new table, snapshots holds the sequence numbers
+// of the live snapshots in increasing order.  The version is unchanged if
+// the table cannot be written.
+func (v *Version) WriteLevel0Table(imm *memtable.MemTable, snapshots []uint64) error {
 	var meta FileMetaData
-	meta.allowSeeks = 1 << 30
-	meta.number = v.nextFileNumber
-	v.nextFileNumber++
-	builder := sstable.NewTableBuilder(common.GetTableFileName(v.tableCache.dbName, meta.number))
+	meta.number = v.NewFileNumber()
+	fileName := common.GetTableFileName(v.tableCache.dbName, meta.number)
+	builder := sstable.NewTableBuilder(fileName, v.tableCache.opts)
+	if builder == nil {
+		return common.ErrCreateFile
+	}
+	// Writes wait for the flush
+	builder.SetIOPriority(ratelimit.PriorityHigh)
+	var filter options.CompactionFilter
+	if v.tableCache.opts.CompactionFilterOnFlush {
+		filter = v.tableCache.opts.CompactionFilter
+	}
+	ucmp := v.icmp.UserComparator
 	iter := imm.NewIterator()
 	iter.SeekToFirst()
 	if iter.Valid() {
-		meta.smallest = iter.InternalKey()
+		meta.smallest = copyKey(iter.InternalKey())
+		var largest *common.InternalKey
 		for ; iter.Valid(); iter.Next() {
-			meta.largest = iter.InternalKey()
-			builder.Add(iter.InternalKey())
+			key := iter.InternalKey()
+			// Only the newest entry of a key may be filtered, and only
+			// if it is newer than all snapshots
+			newest := largest == nil || ucmp.Compare(key.UserKey, largest.UserKey) != 0
+			if filter != nil && newest && key.Type == common.TypeValue &&
+				(len(snapshots) == 0 || key.Seq > snapshots[len(snapshots)-1]) {
+				key = filterEntry(filter, -1, false, key)
+			}
+			largest = key
+			builder.Add(key)
+		}
+		if err := builder.Finish(); err != nil {
+			os.Remove(fileName)
+			return err
 		}
-		builder.Finish()
-		meta.fileSize = uint64(builder.FileSize())
-		meta.smallest.UserValue = nil
-		meta.largest.UserValue = nil
+		meta.fileSize = builder.FileSize()
+		meta.formatVersion = sstable.CurrentFormatVersion
+		meta.allowSeeks = allowSeeksForSize(meta.fileSize)
+		meta.largest = copyKey(largest)
 	}
 
 	// 挑选合适的level
 	level := 0
-	if !v.overlapInLevel(0, meta.smallest.UserKey, meta.largest.UserKey) {
-		for ; level < common.MaxMemCompactLevel; level++ {
-			if v.overlapInLevel(level+1, meta.smallest.UserKey, meta.largest.UserKey) {
+	if v.tableCache.opts.CompactionStyle != options.CompactionStyleUniversal {
+		level = v.pickLevelForRange(meta.smallest.UserKey, meta.largest.UserKey, common.MaxMemCompactLevel)
+	}
+	v.addFile(level, &meta)
+	return nil
+}
+
+// Adds an external table, which has already been moved to its place in the
+// database, at the lowest level it can go without overlapping.  Returns the
+// chosen level.
+func (v *Version) AddExternalFile(number, fileSize uint64, formatVersion uint32, smallest, largest *common.InternalKey) int {
+	var meta FileMetaData
+	meta.number = number
+	meta.fileSize = fileSize
+	meta.formatVersion = formatVersion
+	meta.allowSeeks = allowSeeksForSize(fileSize)
+	meta.smallest = copyKey(smallest)
+	meta.largest = copyKey(largest)
+
+	level := v.pickLevelForRange(meta.smallest.UserKey, meta.largest.UserKey, common.NumLevels-1)
+	if v.tableCache.opts.CompactionStyle == options.CompactionStyleUniversal && level < common.NumLevels-1 {
+		// Universal compaction only uses level 0 and the last level
+		level = 0
+	}
+	v.addFile(level, &meta)
+	return level
+}
+
+// Returns the deepest level, up to maxLevel, that a file covering the
+// range can be placed in without any level above it overlapping the range.
+func (v *Version) pickLevelForRange(smallest, largest []byte, maxLevel int) int {
+	level := 0
+	if !v.overlapInLevel(0, smallest, largest) {
+		for ; level < maxLevel; level++ {
+			if v.overlapInLevel(level+1, smallest, largest) {
 				break
 			}
 		}
 	}
+	return level
+}
 
-	v.addFile(level, &meta)
+// Returns a new file number, safe to call from the goroutines of
+// subcompactions.
+func (v *Version) NewFileNumber() uint64 {
+	return atomic.AddUint64(&v.nextFileNumber, 1) - 1
 }
 
-func (v *Version) DoCompactionWork() bool {
+// Runs the compaction of the level most in need of one.  snapshots
+// holds the sequence numbers of the live snapshots in increasing order,
+// the entries they see are preserved.  Returns false if there was nothing
+// to compact.
+func (v *Version) DoCompactionWork(snapshots []uint64) bool {
 	c := v.pickCompaction()
 	if c == nil {
 		return false
 	}
+	c.snapshots = snapshots
 	log.Infof("DoCompactionWork begin\n")
 	defer log.Infof("DoCompactionWork end\n")
+	if err := v.runCompaction(c); err != nil {
+		log.Errorf("DoCompactionWork: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// Compacts one chunk of the user key range [begin,end] in level into the
+// next level, a nil begin means before all keys, a nil end after all keys.
+// Returns the key after which the next chunk starts, or nil once the
+// level holds nothing more in the range.  The bytes read and written are
+// added to stats, snapshots is as for DoCompactionWork.  With universal
+// compaction, compacting level 0 merges all runs into the last level
+// whatever the range.
+func (v *Version) CompactRange(level int, begin, end []byte, snapshots []uint64, stats *CompactionStats) ([]byte, error) {
+	if v.tableCache.opts.CompactionStyle == options.CompactionStyleUniversal {
+		return nil, v.compactAllRuns(level, snapshots, stats)
+	}
+	c, more := v.compactRange(level, begin, end, common.MaxFileSize)
+	if c == nil {
+		return nil, nil
+	}
+	c.snapshots = snapshots
+	c.manual = true
+	_, largest := v.getRange(c.inputs[0])
+	if err := v.runCompaction(c); err != nil {
+		return nil, err
+	}
+	stats.add(c)
+	if !more {
+		return nil, nil
+	}
+	return largest.UserKey, nil
+}
+
+// Runs the compaction and installs its outputs in the version.
+func (v *Version) runCompaction(c *Compaction) error {
 	c.Log()
+	for which := 0; which < 2; which++ {
+		for i := 0; i < len(c.inputs[which]); i++ {
+			c.bytesRead += c.inputs[which][i].fileSize
+		}
+	}
 	if c.isTrivialMove() {
 		// Move file to next level
 		v.deleteFile(c.level, c.inputs[0][0])
-		v.addFile(c.level+1, c.inputs[0][0])
-		return true
+		v.addFile(c.outputLevel, c.inputs[0][0])
+		c.bytesRead = 0
+		return nil
 	}
-	var list []*FileMetaData
-	var currentKey *common.InternalKey
-	iter := v.getInputIterator(c)
-	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
-		var meta FileMetaData
-		meta.allowSeeks = 1 << 30
-		meta.number = v.nextFileNumber
-		v.nextFileNumber++
-		builder := sstable.NewTableBuilder(common.GetTableFileName(v.tableCache.dbName, meta.number))
-
-		meta.smallest = iter.InternalKey()
-		for ; iter.Valid(); iter.Next() {
-			if currentKey != nil {
-				// deduplicate
-				ret := common.UserKeyComparator(iter.InternalKey().UserKey, currentKey.UserKey)
-				if ret == 0 {
-					continue
-				} else if ret < 0 {
-					log.Fatalf("%s < %s", string(iter.InternalKey().UserKey), string(currentKey.UserKey))
+	filter := v.tableCache.opts.CompactionFilter
+	if filter != nil {
+		log.Infof("Compaction filter: %s", filter.Name())
+	}
+	subs := c.split(v.tableCache.opts.MaxSubcompactions)
+	if len(subs) == 1 {
+		v.runSubcompaction(subs[0])
+	} else {
+		log.Infof("Compaction split into %d subcompactions", len(subs))
+		var wg sync.WaitGroup
+		for _, sub := range subs {
+			wg.Add(1)
+			go func(sub *subcompaction) {
+				defer wg.Done()
+				v.runSubcompaction(sub)
+			}(sub)
+		}
+		wg.Wait()
+	}
+
+	// The outputs of all subcompactions are installed together, or none
+	// of them if one failed
+	for _, sub := range subs {
+		if sub.err != nil {
+			for _, sub := range subs {
+				for _, meta := range sub.outputs {
+					os.Remove(common.GetTableFileName(v.tableCache.dbName, meta.number))
 				}
-				currentKey = iter.InternalKey()
-			}
-			meta.largest = iter.InternalKey()
-			builder.Add(iter.InternalKey())
-			if builder.FileSize() > common.MaxFileSize {
-				break
 			}
+			return sub.err
 		}
-		builder.Finish()
-		meta.fileSize = uint64(builder.FileSize())
-		meta.smallest.UserValue = nil
-		meta.largest.UserValue = nil
-
-		list = append(list, &meta)
 	}
-
 	for i := 0; i < len(c.inputs[0]); i++ {
 		v.deleteFile(c.level, c.inputs[0][i])
 	}
 	for i := 0; i < len(c.inputs[1]); i++ {
-		v.deleteFile(c.level+1, c.inputs[1][i])
+		v.deleteFile(c.outputLevel, c.inputs[1][i])
 	}
-	for i := 0; i < len(list); i++ {
-		v.addFile(c.level+1, list[i])
+	for _, sub := range subs {
+		c.bytesWritten += sub.bytesWritten
+		for i := 0; i < len(sub.outputs); i++ {
+			v.addFile(c.outputLevel, sub.outputs[i])
+		}
 	}
-	return true
+	return nil
+}
+
+// Writes the entries of the subcompaction which survive to new tables,
+// the version is only read.
+func (v *Version) runSubcompaction(sub *subcompaction) {
+	c := sub.c
+	iter, err := v.getInputIterator(sub)
+	if err != nil {
+		sub.err = err
+		return
+	}
+	defer iter.Close()
+
+	var meta *FileMetaData
+	var builder *sstable.TableBuilder
+	var largest *common.InternalKey
+	// A failed output is still listed, so that it is removed along with
+	// the others
+	finishOutput := func() {
+		sub.err = builder.Finish()
+		meta.fileSize = builder.FileSize()
+		meta.formatVersion = sstable.CurrentFormatVersion
+		meta.allowSeeks = allowSeeksForSize(meta.fileSize)
+		meta.largest = copyKey(largest)
+		sub.bytesWritten += meta.fileSize
+		sub.outputs = append(sub.outputs, meta)
+		builder = nil
+	}
+
+	filter := v.tableCache.opts.CompactionFilter
+	ucmp := v.icmp.UserComparator
+	var currentUserKey []byte
+	hasCurrentUserKey := false
+	lastStripe := 0
+	if sub.start != nil {
+		iter.Seek(sub.start)
+	} else {
+		iter.SeekToFirst()
+	}
+	for ; iter.Valid(); iter.Next() {
+		key := iter.InternalKey()
+		firstOfUserKey := !hasCurrentUserKey || ucmp.Compare(key.UserKey, currentUserKey) != 0
+		if firstOfUserKey {
+			if sub.pastEnd(key.UserKey) {
+				break
+			}
+			// First occurrence of this user key
+			currentUserKey = append(currentUserKey[:0], key.UserKey...)
+			hasCurrentUserKey = true
+			lastStripe = -1
+		}
+
+		// Every snapshot seeing this entry also sees the newer entry of
+		// the key in the same stripe, so only the newest one is kept
+		stripe := c.snapshotStripe(key.Seq)
+		if filter != nil && key.Type == common.TypeValue && stripe == len(c.snapshots) && stripe != lastStripe {
+			// The newest entry of the key, and no snapshot sees it
+			key = filterEntry(filter, c.level, c.manual, key)
+		}
+		drop := false
+		if stripe == lastStripe {
+			// Hidden by a newer entry for same user key
+			drop = true
+		} else if key.Type == common.TypeDeletion && stripe == 0 && sub.isBaseLevelForKey(key.UserKey) {
+			// For this user key:
+			// (1) there is no data in higher levels
+			// (2) data in lower levels will have larger sequence numbers
+			// (3) data in layers that are being compacted here and have
+			//     smaller sequence numbers will be dropped in the next
+			//     few iterations of this loop (by the rule above).
+			// Therefore this deletion marker is obsolete and can be dropped.
+			drop = true
+		}
+		lastStripe = stripe
+
+		// Versions of a user key are never split across tables, a lookup
+		// only probes one table per level
+		if firstOfUserKey {
+			stop := sub.shouldStopBefore(key)
+			// A run of level 0 is a single table
+			if builder != nil && c.outputLevel > 0 && (stop || builder.FileSize() > common.MaxFileSize) {
+				if finishOutput(); sub.err != nil {
+					return
+				}
+			}
+		}
+		if drop {
+			continue
+		}
+		if builder == nil {
+			meta = new(FileMetaData)
+			meta.number = v.NewFileNumber()
+			meta.smallest = copyKey(key)
+			builder = sstable.NewTableBuilder(common.GetTableFileName(v.tableCache.dbName, meta.number), v.tableCache.opts)
+			if builder == nil {
+				sub.err = common.ErrCreateFile
+				return
+			}
+		}
+		largest = key
+		builder.Add(key)
+	}
+	if builder != nil {
+		if finishOutput(); sub.err != nil {
+			return
+		}
+	}
+	// The entries of a block which failed to read are missing from the
+	// outputs, so they must not replace the inputs
+	sub.err = iter.Err()
 }
 
 // Add the specified file at the specified level.
@@ -316,6 +688,16 @@ func (v *Version) deleteFile(level int, meta *FileMetaData) {
 	}
 }
 
+// Returns true iff the file is in the specified level.
+func (v *Version) containsFile(level int, meta *FileMetaData) bool {
+	for i := 0; i < len(v.files[level]); i++ {
+		if v.files[level][i] == meta {
+			return true
+		}
+	}
+	return false
+}
+
 // Returns true iff some file in the specified level overlaps
 func (v *Version) overlapInLevel(level int, smallest, largest []byte) bool {
 	numFiles := len(v.files[level])
@@ -325,7 +707,7 @@ func (v *Version) overlapInLevel(level int, smallest, largest []byte) bool {
 	if level == 0 {
 		for i := 0; i < numFiles; i++ {
 			f := v.files[level][i]
-			if common.UserKeyComparator(smallest, f.largest.UserKey) > 0 || common.UserKeyComparator(f.smallest.UserKey, largest) > 0 {
+			if v.icmp.UserComparator.Compare(smallest, f.largest.UserKey) > 0 || v.icmp.UserComparator.Compare(f.smallest.UserKey, largest) > 0 {
 				continue
 			} else {
 				return true
@@ -336,51 +718,86 @@ func (v *Version) overlapInLevel(level int, smallest, largest []byte) bool {
 		if index >= numFiles {
 			return false
 		}
-		if common.UserKeyComparator(largest, v.files[level][index].smallest.UserKey) > 0 {
+		if v.icmp.UserComparator.Compare(largest, v.files[level][index].smallest.UserKey) >= 0 {
 			return true
 		}
 	}
 	return false
 }
 
-func (v *Version) getInputIterator(c *Compaction) *MergingIterator {
-	var list []*sstable.Iterator
-	for i := 0; i < len(c.inputs[0]); i++ {
-		list = append(list, v.tableCache.NewSSTIterator(c.inputs[0][i].number))
+// Returns an iterator over the input files holding keys of the
+// subcompaction.
+func (v *Version) getInputIterator(sub *subcompaction) (*MergingIterator, error) {
+	c := sub.c
+	// The inputs are read only once, don't let them push other blocks
+	// out of the cache
+	ro := options.NewReadOptions()
+	ro.FillCache = false
+	if v.tableCache.opts.RateLimitCompactionReads {
+		ro.RateLimiter = v.tableCache.opts.RateLimiter
 	}
-	for i := 0; i < len(c.inputs[1]); i++ {
-		list = append(list, v.tableCache.NewSSTIterator(c.inputs[1][i].number))
+	var list []*sstable.Iterator
+	for which := 0; which < 2; which++ {
+		for i := 0; i < len(c.inputs[which]); i++ {
+			if !sub.overlaps(c.inputs[which][i]) {
+				continue
+			}
+			it, err := v.tableCache.NewSSTIterator(c.inputs[which][i].number, ro)
+			if err != nil {
+				NewMergingIterator(v.icmp, list).Close()
+				return nil, err
+			}
+			list = append(list, it)
+		}
 	}
-	return NewMergingIterator(list)
+	return NewMergingIterator(v.icmp, list), nil
 }
 
 func (v *Version) pickCompaction() *Compaction {
+	if v.tableCache.opts.CompactionStyle == options.CompactionStyleUniversal {
+		if c := v.pickUniversalCompaction(); c != nil {
+			return c
+		}
+		return v.pickUniversalUpgrade()
+	}
 	var c Compaction
+	c.inputVersion = v
+	var seekFile, oldFormatFile *FileMetaData
 	c.level = v.pickCompactionLevel()
+	if c.level < 0 && v.fileToCompact != nil {
+		// Nothing is over its size limit, but a file was probed in vain
+		// too many times
+		if v.containsFile(v.fileToCompactLevel, v.fileToCompact) {
+			c.level = v.fileToCompactLevel
+			seekFile = v.fileToCompact
+		}
+		v.fileToCompact = nil
+	}
 	if c.level < 0 {
-		return nil
+		// Spend the time rewriting a table written in an older
+		// format instead
+		c.level, oldFormatFile = v.pickOldFormatFile()
+		if c.level < 0 {
+			return nil
+		}
+		if c.level == common.NumLevels-1 {
+			return v.upgradeLastLevelFile(oldFormatFile)
+		}
+		c.upgradeFormat = true
 	}
 
-	var smallest, largest *common.InternalKey
 	// Files in level 0 may overlap each other, so pick up all overlapping ones
 	if c.level == 0 {
 		c.inputs[0] = append(c.inputs[0], v.files[c.level]...)
-		smallest = c.inputs[0][0].smallest
-		largest = c.inputs[0][0].largest
-		for i := 1; i < len(c.inputs[0]); i++ {
-			f := c.inputs[0][i]
-			if common.InternalKeyComparator(f.largest, largest) > 0 {
-				largest = f.largest
-			}
-			if common.InternalKeyComparator(f.smallest, smallest) < 0 {
-				smallest = f.smallest
-			}
-		}
+	} else if seekFile != nil {
+		c.inputs[0] = append(c.inputs[0], seekFile)
+	} else if oldFormatFile != nil {
+		c.inputs[0] = append(c.inputs[0], oldFormatFile)
 	} else {
 		// Pick the first file that comes after compact_pointer_[level]
 		for i := 0; i < len(v.files[c.level]); i++ {
 			f := v.files[c.level][i]
-			if v.compactPointer[c.level] == nil || common.InternalKeyComparator(f.largest, v.compactPointer[c.level]) > 0 {
+			if v.compactPointer[c.level] == nil || v.icmp.Compare(f.largest, v.compactPointer[c.level]) > 0 {
 				c.inputs[0] = append(c.inputs[0], f)
 				break
 			}
@@ -388,19 +805,176 @@ func (v *Version) pickCompaction() *Compaction {
 		if len(c.inputs[0]) == 0 {
 			c.inputs[0] = append(c.inputs[0], v.files[c.level][0])
 		}
-		smallest = c.inputs[0][0].smallest
-		largest = c.inputs[0][0].largest
 	}
-	for i := 0; i < len(v.files[c.level+1]); i++ {
-		f := v.files[c.level+1][i]
+	c.outputLevel = c.level + 1
+	v.setupOtherInputs(&c)
+	return &c
+}
+
+// Returns a compaction of the files in level overlapping the user key
+// range [begin,end] into the next level, or nil if there is none.  A nil
+// begin means before all keys, a nil end after all keys.  Unless level is
+// 0, the inputs are cut after about maxBytes, more is then true and the
+// caller continues after the largest key of the compaction to cover the
+// rest of the range.
+func (v *Version) compactRange(level int, begin, end []byte, maxBytes uint64) (c *Compaction, more bool) {
+	inputs := v.getOverlappingInputs(level, begin, end)
+	if len(inputs) == 0 {
+		return nil, false
+	}
+	// Avoid compacting too much in one shot in case the range is large.
+	// But we cannot do this for level-0 since level-0 files can overlap
+	// and we must not pick one file and drop another older file if the
+	// two files overlap.
+	if level > 0 {
+		var total uint64
+		for i := 0; i < len(inputs); i++ {
+			total += inputs[i].fileSize
+			if total >= maxBytes && i+1 < len(inputs) {
+				inputs = inputs[:i+1]
+				more = true
+				break
+			}
+		}
+	}
+	c = new(Compaction)
+	c.inputVersion = v
+	c.level = level
+	c.outputLevel = level + 1
+	c.inputs[0] = inputs
+	v.setupOtherInputs(c)
+	return c, more
+}
+
+// Adds the files of the next level overlapping the inputs of c, and the
+// files of the input level which fit in without adding more.
+func (v *Version) setupOtherInputs(c *Compaction) {
+	opts := v.tableCache.opts
+	level := c.level
+	smallest, largest := v.getRange(c.inputs[0])
+	c.inputs[1] = v.getOverlappingInputs(level+1, smallest.UserKey, largest.UserKey)
+
+	// Get entire range covered by compaction
+	allStart, allLimit := v.getRange(append(append([]*FileMetaData(nil), c.inputs[0]...), c.inputs[1]...))
+
+	// See if we can grow the number of inputs in "level" without
+	// changing the number of "level+1" files we pick up.
+	if len(c.inputs[1]) > 0 {
+		expanded0 := v.getOverlappingInputs(level, allStart.UserKey, allLimit.UserKey)
+		inputs1Size := totalFileSize(c.inputs[1])
+		expanded0Size := totalFileSize(expanded0)
+		if len(expanded0) > len(c.inputs[0]) && inputs1Size+expanded0Size < opts.ExpandedCompactionByteSizeLimit {
+			newStart, newLimit := v.getRange(expanded0)
+			expanded1 := v.getOverlappingInputs(level+1, newStart.UserKey, newLimit.UserKey)
+			if len(expanded1) == len(c.inputs[1]) {
+				log.Infof("Expanding@%d %d+%d (%d+%d bytes) to %d+%d (%d+%d bytes)",
+					level, len(c.inputs[0]), len(c.inputs[1]), totalFileSize(c.inputs[0]), inputs1Size,
+					len(expanded0), len(expanded1), expanded0Size, inputs1Size)
+				c.inputs[0] = expanded0
+				c.inputs[1] = expanded1
+				allStart, allLimit = v.getRange(append(append([]*FileMetaData(nil), c.inputs[0]...), c.inputs[1]...))
+			}
+		}
+	}
+
+	// Compute the set of grandparent files that overlap this compaction
+	// (parent == level+1; grandparent == level+2)
+	if level+2 < common.NumLevels {
+		c.grandparents = v.getOverlappingInputs(level+2, allStart.UserKey, allLimit.UserKey)
+	}
+	c.maxGrandparentOverlapBytes = opts.MaxGrandparentOverlapBytes
+}
+
+func totalFileSize(files []*FileMetaData) uint64 {
+	var sum uint64
+	for i := 0; i < len(files); i++ {
+		sum += files[i].fileSize
+	}
+	return sum
+}
+
+// Returns the smallest and largest key of the files.
+// REQUIRES: files is not empty
+func (v *Version) getRange(files []*FileMetaData) (*common.InternalKey, *common.InternalKey) {
+	smallest := files[0].smallest
+	largest := files[0].largest
+	for i := 1; i < len(files); i++ {
+		f := files[i]
+		if v.icmp.Compare(f.largest, largest) > 0 {
+			largest = f.largest
+		}
+		if v.icmp.Compare(f.smallest, smallest) < 0 {
+			smallest = f.smallest
+		}
+	}
+	return smallest, largest
+}
 
-		if common.InternalKeyComparator(f.largest, smallest) < 0 || common.InternalKeyComparator(f.smallest, largest) > 0 {
-			// do nothing
+// Returns the files in level overlapping the user key range [begin,end],
+// a nil begin means before all keys, a nil end after all keys.
+func (v *Version) getOverlappingInputs(level int, begin, end []byte) []*FileMetaData {
+	ucmp := v.icmp.UserComparator
+	var inputs []*FileMetaData
+	for i := 0; i < len(v.files[level]); {
+		f := v.files[level][i]
+		i++
+		fileStart := f.smallest.UserKey
+		fileLimit := f.largest.UserKey
+		if begin != nil && ucmp.Compare(fileLimit, begin) < 0 {
+			// "f" is completely before specified range; skip it
+		} else if end != nil && ucmp.Compare(fileStart, end) > 0 {
+			// "f" is completely after specified range; skip it
 		} else {
-			c.inputs[1] = append(c.inputs[1], f)
+			inputs = append(inputs, f)
+			if level == 0 {
+				// Level-0 files may overlap each other.  So check if the newly
+				// added file has expanded the range.  If so, restart search.
+				if begin != nil && ucmp.Compare(fileStart, begin) < 0 {
+					begin = fileStart
+					inputs = nil
+					i = 0
+				} else if end != nil && ucmp.Compare(fileLimit, end) > 0 {
+					end = fileLimit
+					inputs = nil
+					i = 0
+				}
+			}
 		}
 	}
-	return &c
+	return inputs
+}
+
+// Returns true iff some file in level overlaps the user key range
+// [begin,end], a nil begin means before all keys, a nil end after all keys.
+func (v *Version) OverlapInRange(level int, begin, end []byte) bool {
+	return len(v.getOverlappingInputs(level, begin, end)) > 0
+}
+
+// Returns the first table not written in the current format and its level,
+// or -1 if there is none.
+func (v *Version) pickOldFormatFile() (int, *FileMetaData) {
+	for level := 0; level < common.NumLevels; level++ {
+		for i := 0; i < len(v.files[level]); i++ {
+			f := v.files[level][i]
+			if f.formatVersion < sstable.CurrentFormatVersion {
+				return level, f
+			}
+		}
+	}
+	return -1, nil
+}
+
+// Returns the compaction rewriting a table of the last level in the
+// current format.  There is no level to compact it into, so the output
+// replaces it in the last level.
+func (v *Version) upgradeLastLevelFile(f *FileMetaData) *Compaction {
+	c := new(Compaction)
+	c.inputVersion = v
+	c.level = common.NumLevels - 1
+	c.outputLevel = c.level
+	c.inputs[0] = []*FileMetaData{f}
+	c.upgradeFormat = true
+	return c
 }
 
 func (v *Version) pickCompactionLevel() int {
@@ -440,6 +1014,22 @@ func (v *Version) pickCompactionLevel() int {
 	return compactionLevel
 }
 
+// Returns an estimate of the bytes compactions have to rewrite to bring
+// every level back under its size limit.
+func (v *Version) PendingCompactionBytes() uint64 {
+	var pending uint64
+	if len(v.files[0]) >= common.L0CompactionTrigger {
+		pending += totalFileSize(v.files[0])
+	}
+	for level := 1; level < common.NumLevels-1; level++ {
+		size := float64(totalFileSize(v.files[level]))
+		if limit := maxBytesForLevel(level); size > limit {
+			pending += uint64(size - limit)
+		}
+	}
+	return pending
+}
+
 func maxBytesForLevel(level int) float64 {
 	// Note: the result for level zero is not really used since we set
 	// the level-0 compaction threshold based on number of files.
@@ -4,32 +4,780 @@ package version
 import (
 	"asukadb/common"
 	"asukadb/memtable"
+	"asukadb/options"
+	"asukadb/sstable"
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
 func Test_Version_Get(t *testing.T) {
-	v := New("./temp_ver_0")
+	v := New("./temp_ver_0", options.New())
 	var f FileMetaData
 	f.number = 123
 	f.smallest = common.NewInternalKey(1, common.TypeValue, []byte("123"), nil)
 	f.largest = common.NewInternalKey(1, common.TypeValue, []byte("125"), nil)
 	v.files[0] = append(v.files[0], &f)
 
-	value, err := v.Get([]byte("125"))
+	value, err := v.Get([]byte("125"), nil, nil)
 	fmt.Println(err, value)
 }
 
 func Test_Version_Load(t *testing.T) {
-	v := New("./temp_ver_1")
-	memTable := memtable.New()
+	v := New("./temp_ver_1", options.New())
+	memTable := memtable.New(nil, nil, nil)
 	memTable.Add(1234567, common.TypeValue, []byte("aadsa34a"), []byte("bb23b3423"))
-	v.WriteLevel0Table(memTable)
+	v.WriteLevel0Table(memTable, nil)
 	n, _ := v.Save()
 	fmt.Println(v)
 
-	v2, _ := LoadFromLocal("./temp_ver_1", n)
+	v2, _ := LoadFromLocal("./temp_ver_1", n, options.New())
 	fmt.Println(v2)
-	value, err := v2.Get([]byte("aadsa34a"))
+	value, err := v2.Get([]byte("aadsa34a"), nil, nil)
 	fmt.Println(err, value)
-}
\ No newline at end of file
+}
+// Copies the table written in the legacy format into the version at level.
+func addLegacyTable(t *testing.T, v *Version, dbName string, level int) *FileMetaData {
+	p, err := ioutil.ReadFile(common.GetTableFileName("../sstable/asuka", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f FileMetaData
+	f.number = v.NewFileNumber()
+	f.fileSize = uint64(len(p))
+	f.formatVersion = sstable.LegacyFormatVersion
+	f.smallest = common.NewInternalKey(1, common.TypeValue, []byte("123"), nil)
+	f.largest = common.NewInternalKey(3, common.TypeValue, []byte("125"), nil)
+	if err = ioutil.WriteFile(common.GetTableFileName(dbName, f.number), p, 0644); err != nil {
+		t.Fatal(err)
+	}
+	v.addFile(level, &f)
+	return &f
+}
+
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+func (reverseComparator) Name() string {
+	return "asukadb.ReverseBytewiseComparator"
+}
+
+func (reverseComparator) FindShortestSeparator(start, limit []byte) []byte {
+	return start
+}
+
+func (reverseComparator) FindShortSuccessor(key []byte) []byte {
+	return key
+}
+
+func Test_Version_LegacyManifest(t *testing.T) {
+	// legacy-MANIFEST-000002 was saved by the first version of the
+	// database, without a comparator name
+	v, err := LoadFromLocal("./legacy", 2, options.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if v.NumLevelFiles(0)+v.NumLevelFiles(1)+v.NumLevelFiles(2) != 1 {
+		t.Fatal("the legacy table should be loaded")
+	}
+	opts := options.New()
+	opts.Comparator = reverseComparator{}
+	if _, err = LoadFromLocal("./legacy", 2, opts); err != common.ErrComparatorMismatch {
+		t.Fatal("a legacy database uses the bytewise comparator", err)
+	}
+
+	// a truncated manifest is corrupted
+	var buf bytes.Buffer
+	v.EncodeTo(&buf)
+	for _, n := range []int{0, 4, 12, 20, buf.Len() - 1} {
+		if err = New("./legacy", options.New()).DecodeFrom(bytes.NewReader(buf.Bytes()[:n])); err != common.ErrManifestCorrupted {
+			t.Fatal(n, err)
+		}
+	}
+}
+
+func Test_Version_UpgradeLegacyManifest(t *testing.T) {
+	for _, name := range []string{"000001.sst", "MANIFEST-000002"} {
+		p, err := ioutil.ReadFile("./legacy-" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile("./temp_ver_9-"+name, p, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		files, _ := filepath.Glob("./temp_ver_9-*")
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+	v, err := LoadFromLocal("./temp_ver_9", 2, options.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	var f *FileMetaData
+	for level := 0; level < common.NumLevels; level++ {
+		for _, file := range v.files[level] {
+			f = file
+		}
+	}
+	if f == nil || f.formatVersion != sstable.LegacyFormatVersion || f.allowSeeks != allowSeeksForSize(f.fileSize) {
+		t.Fatalf("unexpected legacy table %+v", f)
+	}
+
+	// the legacy table is rewritten once nothing else is left to compact
+	if !v.DoCompactionWork(nil) {
+		t.Fatal("the legacy table should be compacted")
+	}
+	for level := 0; level < common.NumLevels; level++ {
+		for _, file := range v.files[level] {
+			if file.formatVersion != sstable.CurrentFormatVersion {
+				t.Fatalf("table %d is still in format %d", file.number, file.formatVersion)
+			}
+		}
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if value, err := v.Get(key, nil, nil); err != nil || string(value) != string(key) {
+			t.Fatal(string(key), err, string(value))
+		}
+	}
+}
+
+func Test_Version_UpgradeFormat(t *testing.T) {
+	v := New("./temp_ver_2", options.New())
+	f := addLegacyTable(t, v, "./temp_ver_2", 1)
+	defer os.Remove(common.GetTableFileName("./temp_ver_2", f.number))
+
+	if !v.DoCompactionWork(nil) {
+		t.Fatal("the legacy table should be compacted")
+	}
+	if len(v.files[1]) != 0 || len(v.files[2]) != 1 {
+		t.Fatal("the legacy table should be rewritten into the next level")
+	}
+	number := v.files[2][0].number
+	defer os.Remove(common.GetTableFileName("./temp_ver_2", number))
+	formatVersion, err := v.tableCache.FormatVersion(number)
+	if err != nil || formatVersion != sstable.CurrentFormatVersion || v.files[2][0].formatVersion != formatVersion {
+		t.Fatal(err, formatVersion, v.files[2][0].formatVersion)
+	}
+	value, err := v.Get([]byte("124"), nil, nil)
+	if err != nil || string(value) != "1245" {
+		t.Fatal(err, string(value))
+	}
+	if v.DoCompactionWork(nil) {
+		t.Fatal("nothing is left to compact")
+	}
+
+	// the format version survives saving the version
+	var buf bytes.Buffer
+	v.EncodeTo(&buf)
+	v2 := New("./temp_ver_2", options.New())
+	if err = v2.DecodeFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if v2.files[2][0].formatVersion != sstable.CurrentFormatVersion {
+		t.Fatal("the format version should be saved", v2.files[2][0].formatVersion)
+	}
+}
+
+func Test_Version_UpgradeFormatLastLevel(t *testing.T) {
+	for _, style := range []options.CompactionStyle{options.CompactionStyleLevel, options.CompactionStyleUniversal} {
+		opts := options.New()
+		opts.CompactionStyle = style
+		v := New("./temp_ver_3", opts)
+		last := common.NumLevels - 1
+		f := addLegacyTable(t, v, "./temp_ver_3", last)
+		defer os.Remove(common.GetTableFileName("./temp_ver_3", f.number))
+
+		if !v.DoCompactionWork(nil) {
+			t.Fatal("the legacy table should be compacted", style)
+		}
+		if len(v.files[last]) != 1 || v.files[last][0] == f || v.files[last][0].formatVersion != sstable.CurrentFormatVersion {
+			t.Fatal("the legacy table should be rewritten in the last level", style)
+		}
+		defer os.Remove(common.GetTableFileName("./temp_ver_3", v.files[last][0].number))
+		value, err := v.Get([]byte("124"), nil, nil)
+		if err != nil || string(value) != "1245" {
+			t.Fatal(err, string(value))
+		}
+		if v.DoCompactionWork(nil) {
+			t.Fatal("nothing is left to compact", style)
+		}
+	}
+}
+
+func Test_UniversalUpgradeFormat(t *testing.T) {
+	opts := options.New()
+	opts.CompactionStyle = options.CompactionStyleUniversal
+	v := New("./temp_ver_4", opts)
+	f := addLegacyTable(t, v, "./temp_ver_4", 0)
+	defer os.Remove(common.GetTableFileName("./temp_ver_4", f.number))
+	memTable := memtable.New(nil, nil, nil)
+	memTable.Add(10, common.TypeValue, []byte("124"), []byte("new"))
+	v.WriteLevel0Table(memTable, nil)
+	defer os.Remove(common.GetTableFileName("./temp_ver_4", v.files[0][1].number))
+
+	// the legacy run is merged with the newer one, which must still win
+	if !v.DoCompactionWork(nil) {
+		t.Fatal("the legacy table should be compacted")
+	}
+	last := common.NumLevels - 1
+	if len(v.files[0]) != 0 || len(v.files[last]) != 1 {
+		t.Fatal("both runs should be merged into the last level")
+	}
+	defer os.Remove(common.GetTableFileName("./temp_ver_4", v.files[last][0].number))
+	value, err := v.Get([]byte("124"), nil, nil)
+	if err != nil || string(value) != "new" {
+		t.Fatal(err, string(value))
+	}
+	value, err = v.Get([]byte("123"), nil, nil)
+	if err != nil || string(value) != "1234" {
+		t.Fatal(err, string(value))
+	}
+}
+
+func Test_CompactionReadError(t *testing.T) {
+	v := New("./temp_ver_5", options.New())
+	var f FileMetaData
+	f.number = v.NewFileNumber()
+	fileName := common.GetTableFileName("./temp_ver_5", f.number)
+	defer os.Remove(fileName)
+	builder := sstable.NewTableBuilder(fileName, v.tableCache.opts)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%08d", i))
+		builder.Add(common.NewInternalKey(uint64(i+1), common.TypeValue, key, key))
+	}
+	builder.Finish()
+	f.fileSize = builder.FileSize()
+	f.formatVersion = sstable.CurrentFormatVersion
+	f.smallest = common.NewInternalKey(1, common.TypeValue, []byte("00000000"), nil)
+	f.largest = common.NewInternalKey(1000, common.TypeValue, []byte("00000999"), nil)
+	v.addFile(1, &f)
+
+	// open the table while it is whole, then lose its last data blocks
+	if _, err := v.tableCache.GetProperties(f.number); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(fileName, int64(f.fileSize/2)); err != nil {
+		t.Fatal(err)
+	}
+	var stats CompactionStats
+	if _, err := v.CompactRange(1, nil, nil, nil, &stats); err != common.ErrTableFileCorrupted {
+		t.Fatal("the compaction should fail", err)
+	}
+	if len(v.files[1]) != 1 || len(v.files[2]) != 0 {
+		t.Fatal("the input table should stay in place")
+	}
+}
+
+func Test_TableCache(t *testing.T) {
+	opts := options.New()
+	opts.MaxOpenFiles = common.NumNonTableCacheFiles + 1
+	tableCache := NewTableCache("./temp_tc", opts)
+	defer tableCache.Close()
+	writeTable := func(number uint64) {
+		fileName := common.GetTableFileName("./temp_tc", number)
+		builder := sstable.NewTableBuilder(fileName, opts)
+		builder.Add(common.NewInternalKey(1, common.TypeValue, []byte("key"), []byte(fmt.Sprint(number))))
+		builder.Finish()
+	}
+	for number := uint64(1); number <= 2; number++ {
+		writeTable(number)
+		defer os.Remove(common.GetTableFileName("./temp_tc", number))
+	}
+
+	// the iterator keeps table 1 open while table 2 is used
+	it, err := tableCache.NewSSTIterator(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := tableCache.Get(2, []byte("key"), nil); err != nil || string(value) != "2" {
+		t.Fatal(err, string(value))
+	}
+	if n := tableCache.NumOpenFiles(); n != 1 {
+		t.Fatalf("got %d open files", n)
+	}
+	it.SeekToFirst()
+	if !it.Valid() || string(it.Value()) != "1" {
+		t.Fatal("table 1 should stay readable")
+	}
+	it.Close()
+	if value, err := tableCache.Get(2, []byte("key"), nil); err != nil || string(value) != "2" {
+		t.Fatal(err, string(value))
+	}
+	if n := tableCache.NumOpenFiles(); n != 1 {
+		t.Fatalf("got %d open files", n)
+	}
+
+	// failed opens are not cached
+	if _, err = tableCache.Get(3, []byte("key"), nil); err == nil {
+		t.Fatal("table 3 does not exist yet")
+	}
+	writeTable(3)
+	defer os.Remove(common.GetTableFileName("./temp_tc", 3))
+	if value, err := tableCache.Get(3, []byte("key"), nil); err != nil || string(value) != "3" {
+		t.Fatal(err, string(value))
+	}
+	tableCache.Close()
+	if n := tableCache.NumOpenFiles(); n != 0 {
+		t.Fatalf("got %d open files", n)
+	}
+}
+
+func Test_TableCacheConcurrentOpen(t *testing.T) {
+	opts := options.New()
+	tableCache := NewTableCache("./temp_tc", opts)
+	defer tableCache.Close()
+	fileName := common.GetTableFileName("./temp_tc", 1)
+	defer os.Remove(fileName)
+	builder := sstable.NewTableBuilder(fileName, opts)
+	builder.Add(common.NewInternalKey(1, common.TypeValue, []byte("key"), []byte("value")))
+	builder.Finish()
+
+	// lookups racing to open the table all end up with the cached copy
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := tableCache.Get(1, []byte("key"), nil); err != nil || string(value) != "value" {
+				t.Error(err, string(value))
+			}
+		}()
+	}
+	wg.Wait()
+	if n := tableCache.NumOpenFiles(); n != 1 {
+		t.Fatalf("got %d open files", n)
+	}
+}
+
+func Test_SeekCompaction(t *testing.T) {
+	v := New("./temp_ver_3", options.New())
+	defer v.Close()
+	writeTable := func(keys ...string) {
+		memTable := memtable.New(nil, nil, nil)
+		for i, key := range keys {
+			memTable.Add(v.NextSeq(), common.TypeValue, []byte(key), []byte(fmt.Sprint(i)))
+		}
+		v.WriteLevel0Table(memTable, nil)
+	}
+	writeTable("a", "c")
+	writeTable("b", "d")
+	defer func() {
+		files, _ := filepath.Glob("./temp_ver_3-*")
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+	if len(v.files[1]) != 1 || len(v.files[2]) != 1 {
+		t.Fatal("the tables should be in level 1 and 2")
+	}
+	allowSeeks := v.files[1][0].allowSeeks
+	if allowSeeks != 100 {
+		t.Fatalf("got %d seeks allowed", allowSeeks)
+	}
+
+	// every lookup of "c" probes the table in level 1 first
+	for i := int64(1); i <= allowSeeks; i++ {
+		var stats GetStats
+		value, err := v.Get([]byte("c"), nil, &stats)
+		if err != nil || string(value) != "1" {
+			t.Fatal(err, string(value))
+		}
+		if v.UpdateStats(&stats) != (i == allowSeeks) {
+			t.Fatalf("compaction should be triggered after %d seeks, not %d", allowSeeks, i)
+		}
+	}
+	if !v.DoCompactionWork(nil) {
+		t.Fatal("the table in level 1 should be compacted")
+	}
+	if len(v.files[1]) != 0 || len(v.files[2]) != 1 {
+		t.Fatal("the tables should be merged into level 2")
+	}
+	if value, err := v.Get([]byte("b"), nil, nil); err != nil || string(value) != "0" {
+		t.Fatal(err, string(value))
+	}
+	if v.DoCompactionWork(nil) {
+		t.Fatal("nothing is left to compact")
+	}
+}
+
+type seqSnapshot uint64
+
+func (snapshot seqSnapshot) Sequence() uint64 {
+	return uint64(snapshot)
+}
+
+func Test_CompactionDropRules(t *testing.T) {
+	v := New("./temp_ver_4", options.New())
+	defer v.Close()
+	defer func() {
+		files, _ := filepath.Glob("./temp_ver_4-*")
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+	type entry struct {
+		seq       uint64
+		valueType common.ValueType
+		key       string
+	}
+	writeTable := func(entries ...entry) {
+		memTable := memtable.New(nil, nil, nil)
+		for _, e := range entries {
+			memTable.Add(e.seq, e.valueType, []byte(e.key), []byte(fmt.Sprint(e.seq)))
+		}
+		v.WriteLevel0Table(memTable, nil)
+	}
+	// Returns the entries of the level as key@seq
+	levelEntries := func(level int) []string {
+		var result []string
+		for _, f := range v.files[level] {
+			it, err := v.tableCache.NewSSTIterator(f.number, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for it.SeekToFirst(); it.Valid(); it.Next() {
+				result = append(result, fmt.Sprintf("%s@%d", it.InternalKey().UserKey, it.InternalKey().Seq))
+			}
+			it.Close()
+		}
+		return result
+	}
+
+	writeTable(entry{1, common.TypeValue, "d"}, entry{2, common.TypeValue, "x"})
+	writeTable(
+		entry{3, common.TypeDeletion, "d"},
+		entry{4, common.TypeValue, "k"},
+		entry{5, common.TypeValue, "k"},
+		entry{6, common.TypeValue, "k"},
+		entry{7, common.TypeDeletion, "x"},
+	)
+	if len(v.files[1]) != 1 || len(v.files[2]) != 1 {
+		t.Fatal("the tables should be in level 1 and 2")
+	}
+
+	// k@5 is hidden by k@4 from the snapshot at 4 and by k@6 from the
+	// current state.  Nothing is below level 2, so the deletion of d and
+	// the value it hides are gone, but x@2 is still seen by the snapshot.
+	var stats CompactionStats
+	if _, err := v.CompactRange(1, nil, nil, []uint64{4}, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(levelEntries(2)); got != "[k@6 k@4 x@7 x@2]" {
+		t.Fatalf("got %s", got)
+	}
+	if value, err := v.Get([]byte("k"), &options.ReadOptions{Snapshot: seqSnapshot(4)}, nil); err != nil || string(value) != "4" {
+		t.Fatal(err, string(value))
+	}
+	if _, err := v.Get([]byte("d"), &options.ReadOptions{Snapshot: seqSnapshot(4)}, nil); err != common.ErrNotFound {
+		t.Fatal(err)
+	}
+
+	// a deletion is kept while a deeper level may hold the key
+	for level := 2; level < 4; level++ {
+		if _, err := v.CompactRange(level, nil, nil, nil, &stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTable(entry{11, common.TypeValue, "a"}, entry{12, common.TypeValue, "z"})
+	if _, err := v.CompactRange(2, nil, nil, nil, &stats); err != nil {
+		t.Fatal(err)
+	}
+	writeTable(entry{8, common.TypeDeletion, "k"}, entry{9, common.TypeValue, "k"}, entry{10, common.TypeDeletion, "k"})
+	if len(v.files[2]) != 1 || len(v.files[3]) != 1 || len(v.files[4]) != 1 {
+		t.Fatal("the tables should be in level 2, 3 and 4")
+	}
+	if _, err := v.CompactRange(2, nil, nil, nil, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(levelEntries(3)); got != "[a@11 k@10 z@12]" {
+		t.Fatalf("got %s", got)
+	}
+	if _, err := v.Get([]byte("k"), nil, nil); err != common.ErrDeletion {
+		t.Fatal(err)
+	}
+}
+
+// Returns the metadata of a table which doesn't exist on disk.
+func fakeFile(number, fileSize uint64, smallest, largest string) *FileMetaData {
+	return &FileMetaData{
+		number:   number,
+		fileSize: fileSize,
+		smallest: common.NewInternalKey(1, common.TypeValue, []byte(smallest), nil),
+		largest:  common.NewInternalKey(1, common.TypeValue, []byte(largest), nil),
+	}
+}
+
+func Test_ExpandInputs(t *testing.T) {
+	opts := options.New()
+	v := New("./temp_ver_5", opts)
+	defer v.Close()
+	v.addFile(1, fakeFile(1, 1000, "a", "c"))
+	v.addFile(1, fakeFile(2, 1000, "d", "f"))
+	v.addFile(1, fakeFile(3, 1000, "g", "h"))
+	v.addFile(2, fakeFile(4, 1000, "b", "e"))
+
+	// "d".."f" doesn't add files of level 2
+	c, _ := v.compactRange(1, []byte("a"), []byte("b"), opts.ExpandedCompactionByteSizeLimit)
+	if len(c.inputs[0]) != 2 || len(c.inputs[1]) != 1 {
+		t.Fatalf("got %d+%d inputs", len(c.inputs[0]), len(c.inputs[1]))
+	}
+	opts.ExpandedCompactionByteSizeLimit = 2500
+	c, _ = v.compactRange(1, []byte("a"), []byte("b"), opts.ExpandedCompactionByteSizeLimit)
+	if len(c.inputs[0]) != 1 || len(c.inputs[1]) != 1 {
+		t.Fatalf("got %d+%d inputs over the limit", len(c.inputs[0]), len(c.inputs[1]))
+	}
+}
+
+func Test_GrandparentOverlap(t *testing.T) {
+	opts := options.New()
+	opts.MaxGrandparentOverlapBytes = 1500
+	v := New("./temp_ver_6", opts)
+	defer v.Close()
+	defer func() {
+		files, _ := filepath.Glob("./temp_ver_6-*")
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+	memTable := memtable.New(nil, nil, nil)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		memTable.Add(v.NextSeq(), common.TypeValue, key, key)
+	}
+	v.WriteLevel0Table(memTable, nil)
+	if len(v.files[2]) != 1 {
+		t.Fatal("the table should be in level 2")
+	}
+	// the grandparents of the output of level 2, only their metadata is used
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%03d", 10*i+5)
+		v.addFile(4, fakeFile(v.NewFileNumber(), 1000, key, key))
+	}
+
+	var stats CompactionStats
+	if _, err := v.CompactRange(2, nil, nil, nil, &stats); err != nil {
+		t.Fatal(err)
+	}
+	// a new output is started once two grandparents are passed, before
+	// key016, key036, key056, key076 and key096
+	if len(v.files[3]) != 6 {
+		t.Fatalf("got %d output tables", len(v.files[3]))
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if value, err := v.Get(key, nil, nil); err != nil || string(value) != string(key) {
+			t.Fatal(err, string(value))
+		}
+	}
+}
+
+func Test_Subcompactions(t *testing.T) {
+	opts := options.New()
+	opts.MaxSubcompactions = 4
+	v := New("./temp_ver_7", opts)
+	defer v.Close()
+	defer func() {
+		files, _ := filepath.Glob("./temp_ver_7-*")
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+	// four disjoint tables go to level 2
+	for j := 0; j < 4; j++ {
+		memTable := memtable.New(nil, nil, nil)
+		for i := 100 * j; i < 100*(j+1); i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			memTable.Add(v.NextSeq(), common.TypeValue, key, []byte("old"))
+		}
+		v.WriteLevel0Table(memTable, nil)
+	}
+	// and the table overwriting them all to level 1
+	memTable := memtable.New(nil, nil, nil)
+	for i := 0; i < 400; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		memTable.Add(v.NextSeq(), common.TypeValue, key, key)
+	}
+	v.WriteLevel0Table(memTable, nil)
+	if len(v.files[1]) != 1 || len(v.files[2]) != 4 {
+		t.Fatalf("got %d tables in level 1 and %d in level 2", len(v.files[1]), len(v.files[2]))
+	}
+
+	var stats CompactionStats
+	if _, err := v.CompactRange(1, nil, nil, nil, &stats); err != nil {
+		t.Fatal(err)
+	}
+	// each subcompaction writes its own tables, split at key100, key200
+	// and key300
+	if len(v.files[1]) != 0 || len(v.files[2]) != 4 {
+		t.Fatalf("got %d tables in level 1 and %d in level 2", len(v.files[1]), len(v.files[2]))
+	}
+	numbers := make(map[uint64]bool)
+	for i, f := range v.files[2] {
+		if numbers[f.number] {
+			t.Fatalf("file number %d used twice", f.number)
+		}
+		numbers[f.number] = true
+		if i > 0 && bytes.Compare(v.files[2][i-1].largest.UserKey, f.smallest.UserKey) >= 0 {
+			t.Fatal("the outputs overlap")
+		}
+	}
+	for i := 0; i < 400; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if value, err := v.Get(key, nil, nil); err != nil || string(value) != string(key) {
+			t.Fatal(string(key), err, string(value))
+		}
+	}
+}
+
+func Test_SubcompactionFailure(t *testing.T) {
+	if err := os.Mkdir("./temp_ver_8", 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("./temp_ver_8")
+	opts := options.New()
+	opts.MaxSubcompactions = 4
+	v := New("./temp_ver_8/db", opts)
+	defer v.Close()
+	for j := 0; j < 4; j++ {
+		memTable := memtable.New(nil, nil, nil)
+		for i := 100 * j; i < 100*(j+1); i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			memTable.Add(v.NextSeq(), common.TypeValue, key, []byte("old"))
+		}
+		v.WriteLevel0Table(memTable, nil)
+	}
+	memTable := memtable.New(nil, nil, nil)
+	for i := 0; i < 400; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		memTable.Add(v.NextSeq(), common.TypeValue, key, key)
+	}
+	v.WriteLevel0Table(memTable, nil)
+	if len(v.files[1]) != 1 || len(v.files[2]) != 4 {
+		t.Fatalf("got %d tables in level 1 and %d in level 2", len(v.files[1]), len(v.files[2]))
+	}
+
+	// the inputs stay readable through the table cache, but no output
+	// can be created once the directory is gone
+	for level := 1; level <= 2; level++ {
+		for _, f := range v.files[level] {
+			if _, err := v.tableCache.GetProperties(f.number); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := os.RemoveAll("./temp_ver_8"); err != nil {
+		t.Fatal(err)
+	}
+	var stats CompactionStats
+	if _, err := v.CompactRange(1, nil, nil, nil, &stats); err != common.ErrCreateFile {
+		t.Fatal("the compaction should fail", err)
+	}
+	if len(v.files[1]) != 1 || len(v.files[2]) != 4 {
+		t.Fatalf("got %d tables in level 1 and %d in level 2", len(v.files[1]), len(v.files[2]))
+	}
+	if value, err := v.Get([]byte("key123"), nil, nil); err != nil || string(value) != "key123" {
+		t.Fatal(err, string(value))
+	}
+	if err := v.WriteLevel0Table(memTable, nil); err != common.ErrCreateFile {
+		t.Fatal("the flush should fail", err)
+	}
+	if len(v.files[0]) != 0 || len(v.files[1]) != 1 {
+		t.Fatalf("got %d tables in level 0 and %d in level 1", len(v.files[0]), len(v.files[1]))
+	}
+}
+
+func Test_UniversalCompaction(t *testing.T) {
+	opts := options.New()
+	opts.CompactionStyle = options.CompactionStyleUniversal
+	v := New("./temp_ver_8", opts)
+	defer v.Close()
+	defer func() {
+		files, _ := filepath.Glob("./temp_ver_8-*")
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+	last := common.NumLevels - 1
+	// writes the first n keys, an empty value deletes them
+	flush := func(n int, value string) {
+		memTable := memtable.New(nil, nil, nil)
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			if value == "" {
+				memTable.Add(v.NextSeq(), common.TypeDeletion, key, nil)
+			} else {
+				memTable.Add(v.NextSeq(), common.TypeValue, key, []byte(value))
+			}
+		}
+		v.WriteLevel0Table(memTable, nil)
+	}
+	check := func(when string, from, to int, value string, want error) {
+		for i := from; i < to; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			got, err := v.Get(key, nil, nil)
+			if err != want || string(got) != value {
+				t.Fatalf("%s: %s: %v %s", when, key, err, got)
+			}
+		}
+	}
+
+	// flushes go to level 0 even though nothing overlaps them
+	padding := strings.Repeat("-", 100)
+	for i := 0; i < 3; i++ {
+		flush(400, fmt.Sprintf("v%d", i)+padding)
+	}
+	if len(v.files[0]) != 3 || v.DoCompactionWork(nil) {
+		t.Fatal("no compaction is due under the run count trigger")
+	}
+	// the newer runs take three times the space of the oldest one
+	flush(400, "v3"+padding)
+	if !v.DoCompactionWork(nil) || len(v.files[0]) != 0 || len(v.files[last]) == 0 {
+		t.Fatalf("all runs should be merged: %d runs in level 0", len(v.files[0]))
+	}
+	check("merged", 0, 400, "v3"+padding, nil)
+
+	// the three newest runs are much smaller than the oldest one, they
+	// are merged with each other only
+	flush(100, "v4")
+	flush(100, "")
+	flush(100, "v6")
+	bottom := v.files[last]
+	if !v.DoCompactionWork(nil) || len(v.files[0]) != 1 || len(v.files[last]) != len(bottom) || v.files[last][0] != bottom[0] {
+		t.Fatalf("got %d runs in level 0", len(v.files[0]))
+	}
+	check("size ratio", 0, 100, "v6", nil)
+
+	flush(100, "")
+	flush(100, "")
+	flush(100, "")
+	// the deletions hide the oldest run as long as they are in level 0
+	if !v.DoCompactionWork(nil) || len(v.files[0]) != 1 {
+		t.Fatalf("got %d runs in level 0", len(v.files[0]))
+	}
+	check("deleted", 0, 100, "", common.ErrDeletion)
+	check("deleted", 100, 400, "v3"+padding, nil)
+
+	var stats CompactionStats
+	if _, err := v.CompactRange(0, nil, nil, nil, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.files[0]) != 0 || len(v.files[last]) == 0 || stats.Compactions != 1 {
+		t.Fatalf("all runs should be merged, got %d runs in level 0", len(v.files[0]))
+	}
+	check("compacted", 0, 100, "", common.ErrNotFound)
+	check("compacted", 100, 400, "v3"+padding, nil)
+}